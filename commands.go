@@ -0,0 +1,84 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"golang.org/x/term"
+)
+
+// runCommand runs a command line tool instead of the server, e.g.
+// `chirpy keys rotate`.
+func runCommand(cfg *apiConfig, args []string) error {
+	switch {
+	case len(args) == 2 && args[0] == "keys" && args[1] == "rotate":
+		return cfg.rotateKeys()
+	case len(args) == 3 && args[0] == "users" && args[1] == "create-admin":
+		return cfg.createAdmin(args[2])
+	}
+	return fmt.Errorf("unknown command %q", strings.Join(args, " "))
+}
+
+// readPassword reads a password from the terminal without echoing it, or
+// the first line of standard input when it is not a terminal.
+func readPassword() (string, error) {
+	fd := int(os.Stdin.Fd())
+	if term.IsTerminal(fd) {
+		fmt.Fprint(os.Stderr, "Password: ")
+		b, err := term.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		return string(b), err
+	}
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		return "", err
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// createAdmin bootstraps an admin account, `chirpy users create-admin
+// <email>`. An existing account is promoted; otherwise one is created with
+// a password read from standard input, its email taken as verified.
+func (cfg *apiConfig) createAdmin(email string) error {
+	user, err := cfg.db.GetUserByEmail(email)
+	created := err != nil
+	if created {
+		if !mail.ValidAddress(email) {
+			return errors.New("invalid email address")
+		}
+		plaintext, err := readPassword()
+		if err != nil {
+			return err
+		}
+		err = cfg.passwords.Validate(plaintext)
+		if err != nil {
+			return err
+		}
+		user, err = cfg.db.CreateUser(email, plaintext, cfg.passwords)
+		if err != nil {
+			return err
+		}
+	}
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		if u.Deleted() {
+			return errors.New("account is pending deletion")
+		}
+		if created {
+			u.EmailUnverified = false
+		}
+		u.Role = auth.RoleAdmin
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	fmt.Printf("User %d (%s) is now an admin\n", user.ID, user.Email)
+	return nil
+}
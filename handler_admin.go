@@ -0,0 +1,167 @@
+package main
+
+import (
+	"errors"
+	"html/template"
+	"log"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+const (
+	// statsDays is how many days of signups the admin area shows by default
+	statsDays    int = 30
+	maxStatsDays int = 365
+	auditLimit   int = 100
+)
+
+var metricsPage = template.Must(template.New("metrics").Parse(`
+<html>
+<body>
+    <h1>Welcome, Chirpy Admin</h1>
+    <p>Chirpy has been visited {{.Hits}} times!</p>
+    <p>{{.Users}} users, {{.ChirpyRed}} of them on Chirpy Red, have posted {{.Chirps}} chirps.</p>
+    <h2>Signups</h2>
+    <table>
+        {{range .Signups}}<tr><td>{{.Day}}</td><td>{{.Count}}</td></tr>
+        {{end}}
+    </table>
+</body>
+</html>`))
+
+// audit records an admin action, acting as the user behind the request or
+// as the admin API key when there is none.
+func (cfg *apiConfig) audit(r *http.Request, action string, target string, detail string) error {
+	entry := database.AuditEntry{
+		Action: action,
+		Target: target,
+		Detail: detail,
+		IP:     clientIP(r),
+	}
+	if p, ok := auth.PrincipalFrom(r.Context()); ok {
+		entry.ActorID = p.UserID
+	}
+	return cfg.db.RecordAudit(entry)
+}
+
+func (cfg *apiConfig) HandleAdminMetrics(w http.ResponseWriter, r *http.Request) {
+	stats, err := cfg.db.GetStats(cfg.now(), statsDays)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load statistics"))
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	err = metricsPage.Execute(w, payloads.NewStatsResponse(cfg.fileServerHits.Load(), stats))
+	if err != nil {
+		log.Printf("Failed to render metrics page: %v", err)
+	}
+}
+
+// HandleAdminStats is the JSON form of the metrics page, with signups for
+// the number of days given by ?days=.
+func (cfg *apiConfig) HandleAdminStats(w http.ResponseWriter, r *http.Request) {
+	days := statsDays
+	if v := r.URL.Query().Get("days"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > maxStatsDays {
+			errorResponse(w, 400, errors.New("days must be between 1 and "+strconv.Itoa(maxStatsDays)))
+			return
+		}
+		days = n
+	}
+	stats, err := cfg.db.GetStats(cfg.now(), days)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load statistics"))
+		return
+	}
+	jsonResponse(w, 200, payloads.NewStatsResponse(cfg.fileServerHits.Load(), stats))
+}
+
+// HandleReset resets the hit counter. The reset is only made once it has
+// been recorded in the audit log.
+func (cfg *apiConfig) HandleReset(w http.ResponseWriter, r *http.Request) {
+	err := cfg.audit(r, "reset", "", "hits="+strconv.FormatInt(cfg.fileServerHits.Load(), 10))
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not record reset"))
+		return
+	}
+	cfg.resetCounter()
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.WriteHeader(http.StatusOK)
+	w.Write([]byte("OK"))
+}
+
+func (cfg *apiConfig) HandleGetAuditLog(w http.ResponseWriter, r *http.Request) {
+	entries, err := cfg.db.GetAuditLog(auditLimit)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load audit log"))
+		return
+	}
+	jsonResponse(w, 200, entries)
+}
+
+// HandleSetRole changes a user's role. Admins cannot change their own role,
+// so there is always at least the one who made the change left.
+func (cfg *apiConfig) HandleSetRole(w http.ResponseWriter, r *http.Request) {
+	admin, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	id, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		errorResponse(w, 400, errors.New("bad id"))
+		return
+	}
+	req := payloads.RoleRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if !slices.Contains(auth.Roles, req.Role) {
+		errorResponse(w, 400, errors.New("role must be one of "+strings.Join(auth.Roles, ", ")))
+		return
+	}
+	if id == admin.ID {
+		errorResponse(w, 409, errors.New("cannot change your own role"))
+		return
+	}
+	errNotFound := errors.New("user not found")
+	user, err := cfg.db.GetUser(id)
+	if err != nil || user.Deleted() {
+		errorResponse(w, 404, errNotFound)
+		return
+	}
+	err = cfg.audit(r, "role.set", "user:"+strconv.Itoa(user.ID), req.Role)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not record role change"))
+		return
+	}
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		if u.Deleted() {
+			return errNotFound
+		}
+		u.Role = req.Role
+		if req.Role == auth.RoleUser {
+			u.Role = ""
+		}
+		return nil
+	})
+	if errors.Is(err, errNotFound) || errors.Is(err, database.ErrUserNotFound) {
+		errorResponse(w, 404, errNotFound)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	jsonResponse(w, 200, payloads.NewPrivateUser(user))
+}
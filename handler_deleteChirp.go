@@ -2,56 +2,38 @@ package main
 
 import (
 	"errors"
-	"log"
 	"net/http"
 	"strconv"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
 )
 
 func (cfg *apiConfig) HandleDeleteChirp(w http.ResponseWriter, r *http.Request) {
-	ts, err := getTokenString(r)
-	if err != nil {
-		errorResponse(w, 500, err)
-		return
-	}
-
-	token, err := parseTokenString(ts)
-	if err != nil {
-		errorResponse(w, 500, err)
-		return
-	}
-
-	issuer, err := token.Claims.GetIssuer()
-	if err != nil || issuer != "chirpy-access" {
-		log.Println("Invalid token")
-		errorResponse(w, 401, errors.New("invalid token"))
-		return
-	}
-
-	u, err := token.Claims.GetSubject()
+	user, err := cfg.currentUser(r)
 	if err != nil {
 		errorResponse(w, 401, err)
 		return
 	}
-
-	userId, err := strconv.Atoi(u)
 	id, err := strconv.Atoi(r.PathValue("chirp_id"))
 	if err != nil {
 		jsonResponse(w, 500, err.Error())
 		return
 	}
 
-	chirp, err := db.GetChirp(id)
+	chirp, err := cfg.db.GetChirp(id)
 	if err != nil {
 		jsonResponse(w, 404, err.Error())
 		return
 	}
 
-	if userId != chirp.AuthorID {
+	// moderators may delete anyone's chirps
+	p, _ := auth.PrincipalFrom(r.Context())
+	if user.ID != chirp.AuthorID && !p.Can(auth.PermModerateChirps) {
 		jsonResponse(w, 403, "unauthorized")
 		return
 	}
 
-	ok := db.DeleteChirp(id)
+	ok := cfg.db.DeleteChirp(id)
 	if !ok {
 		jsonResponse(w, 500, errors.New("delete failed"))
 		return
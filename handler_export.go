@@ -0,0 +1,151 @@
+package main
+
+import (
+	"archive/zip"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+const (
+	exportTTL time.Duration = time.Hour * 24
+	// exportStale is how long a pending export holds up a new one
+	exportStale time.Duration = time.Hour
+)
+
+// HandleCreateExport starts building an archive of the user's data. Only
+// one export runs per user at a time.
+func (cfg *apiConfig) HandleCreateExport(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	export, err := cfg.db.CreateExport(user.ID, exportStale)
+	if errors.Is(err, database.ErrExportPending) {
+		errorResponse(w, 409, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not start export"))
+		return
+	}
+	go cfg.buildExport(*export)
+	jsonResponse(w, 202, payloads.NewExportResponse(export))
+}
+
+func (cfg *apiConfig) HandleGetExport(w http.ResponseWriter, r *http.Request) {
+	export, err := cfg.getOwnExport(r)
+	if err != nil {
+		errorResponse(w, 404, err)
+		return
+	}
+	jsonResponse(w, 200, payloads.NewExportResponse(export))
+}
+
+func (cfg *apiConfig) HandleDownloadExport(w http.ResponseWriter, r *http.Request) {
+	export, err := cfg.getOwnExport(r)
+	if err != nil {
+		errorResponse(w, 404, err)
+		return
+	}
+	if export.Status != database.ExportReady {
+		errorResponse(w, 409, errors.New("export is not ready"))
+		return
+	}
+	if export.ExpiresAt == nil || cfg.now().After(*export.ExpiresAt) {
+		errorResponse(w, 410, errors.New("export has expired"))
+		return
+	}
+	w.Header().Set("Content-Type", "application/zip")
+	w.Header().Set("Content-Disposition", `attachment; filename="chirpy-export.zip"`)
+	http.ServeFile(w, r, export.Path)
+}
+
+// getOwnExport loads the export named in the path, provided it belongs to the caller.
+func (cfg *apiConfig) getOwnExport(r *http.Request) (*database.Export, error) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		return nil, err
+	}
+	export, err := cfg.db.GetExport(r.PathValue("export_id"))
+	if err != nil || export.UserID != user.ID {
+		return nil, errors.New("Export not found")
+	}
+	return export, nil
+}
+
+// buildExport writes the user's archive and records the outcome on the job.
+func (cfg *apiConfig) buildExport(export database.Export) {
+	path := filepath.Join(cfg.exportDir, export.ID+".zip")
+	err := cfg.writeExportArchive(path, export.UserID)
+	now := cfg.now()
+	export.CompletedAt = &now
+	if err != nil {
+		log.Printf("Export %s failed: %v", export.ID, err)
+		os.Remove(path)
+		export.Status = database.ExportFailed
+	} else {
+		expires := now.Add(exportTTL)
+		export.Status = database.ExportReady
+		export.Path = path
+		export.ExpiresAt = &expires
+	}
+	_, err = cfg.db.UpdateExport(&export)
+	if err != nil {
+		log.Printf("Failed to record export %s: %v", export.ID, err)
+	}
+}
+
+func (cfg *apiConfig) writeExportArchive(path string, userID int) error {
+	data, err := cfg.db.GetUserData(userID)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(cfg.exportDir, 0700)
+	if err != nil {
+		return err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	zw := zip.NewWriter(f)
+	files := map[string]interface{}{
+		"profile.json": payloads.NewPrivateUser(&data.User),
+		"chirps.json":  data.Chirps,
+	}
+	for name, content := range files {
+		fw, err := zw.Create(name)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(fw)
+		enc.SetIndent("", "  ")
+		err = enc.Encode(content)
+		if err != nil {
+			return err
+		}
+	}
+	return zw.Close()
+}
+
+// removeExpiredExports deletes archives whose download window has closed.
+func (cfg *apiConfig) removeExpiredExports() {
+	expired, err := cfg.db.DeleteExpiredExports(cfg.now())
+	if err != nil {
+		log.Printf("Failed to clean up exports: %v", err)
+		return
+	}
+	for _, export := range expired {
+		os.Remove(export.Path)
+	}
+}
@@ -9,10 +9,18 @@ import (
 	"github.com/am1macdonald/chirpy/internal/database"
 )
 
+// GetChirpsHandler lists chirps oldest first, or newest first with
+// ?sort=desc. Signed-in users who do not ask for an order get their
+// default_chirp_sort setting.
 func (cfg *apiConfig) GetChirpsHandler(w http.ResponseWriter, r *http.Request) {
 	author_id := r.URL.Query().Get("author_id")
 	sort_order := r.URL.Query().Get("sort")
-	chirps, err := db.GetChirps()
+	if sort_order == "" {
+		if user, err := cfg.currentUser(r); err == nil {
+			sort_order = user.Settings.DefaultChirpSort
+		}
+	}
+	chirps, err := cfg.db.GetChirps()
 	if author_id != "" {
 		id, err := strconv.Atoi(author_id)
 		if err != nil {
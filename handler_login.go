@@ -0,0 +1,182 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+	"github.com/am1macdonald/chirpy/internal/throttle"
+)
+
+var errInvalidCredentials = errors.New("invalid email or password")
+
+var (
+	accountLoginPolicy = throttle.Policy{
+		FreeAttempts:    5,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute * 5,
+		LockoutAfter:    10,
+		LockoutDuration: time.Minute * 15,
+		Window:          time.Hour,
+	}
+	ipLoginPolicy = throttle.Policy{
+		FreeAttempts:    20,
+		BaseDelay:       time.Second,
+		MaxDelay:        time.Minute,
+		LockoutAfter:    100,
+		LockoutDuration: time.Hour,
+		Window:          time.Hour,
+	}
+)
+
+// accountKey identifies an account for throttling. Attempts are tracked by
+// the email given, whether or not an account exists for it, in the form
+// emails are stored in.
+func accountKey(email string) string {
+	return mail.Normalize(email)
+}
+
+// allowLogin counts a login attempt against both the account and the IP
+// throttles. When either refuses it, the 429 response has been written.
+func (cfg *apiConfig) allowLogin(w http.ResponseWriter, account string, ip string) bool {
+	wait, ok := cfg.loginAccounts.Allow(account)
+	ipWait, ipOK := cfg.loginIPs.Allow(ip)
+	// an attempt refused by one throttle does not count against the other
+	if ok && !ipOK {
+		cfg.loginAccounts.Release(account)
+	}
+	if ipOK && !ok {
+		cfg.loginIPs.Release(ip)
+	}
+	if !ipOK && ipWait > wait {
+		wait, ok = ipWait, false
+	}
+	if !ok {
+		metrics.Login(metrics.LoginThrottled)
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		jsonResponse(w, 429, "too many login attempts, try again later")
+	}
+	return ok
+}
+
+// checkPassword authenticates a login attempt. Failures are throttled per
+// account and per IP, and every failure gets the same response whether or
+// not the email exists. On failure the response has been written.
+func (cfg *apiConfig) checkPassword(w http.ResponseWriter, r *http.Request, email string, password string) (*database.User, bool) {
+	account := accountKey(email)
+	ip := clientIP(r)
+	if !cfg.allowLogin(w, account, ip) {
+		return nil, false
+	}
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil {
+		// spend as long as a real check would, so timing gives nothing away
+		cfg.dummyUser.Validate(password)
+	}
+	if err != nil || !user.Validate(password) || (user.Deleted() && cfg.now().Sub(*user.DeletedAt) > cfg.deletionGrace) {
+		// the attempts were counted when they were allowed
+		metrics.Login(metrics.LoginFailure)
+		jsonResponse(w, 401, errInvalidCredentials.Error())
+		return nil, false
+	}
+	cfg.loginIPs.Release(ip)
+	if user.TwoFactorEnabled() {
+		// with two factors earlier failures keep counting until the code
+		// is right, so knowing the password does not buy more guesses at it
+		cfg.loginAccounts.Release(account)
+	} else {
+		cfg.loginAccounts.Reset(account)
+	}
+	if cfg.passwords.NeedsRehash(user.Password) {
+		// the password is known to be right, so upgrade its hash in passing,
+		// unless it has been changed in the meantime
+		old := user.Password
+		hash, err := cfg.passwords.Hash(password)
+		if err == nil {
+			_, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+				if u.Password == old {
+					u.Password = hash
+				}
+				return nil
+			})
+		}
+		if err != nil {
+			log.Printf("Failed to rehash password for user %d: %v", user.ID, err)
+		}
+	}
+	return user, true
+}
+
+// completeLogin finishes a login once every factor has been checked:
+// logging in during the deletion grace period restores the account, then
+// access and refresh tokens are issued.
+func (cfg *apiConfig) completeLogin(w http.ResponseWriter, r *http.Request, user *database.User, device string, expiresInSeconds int) {
+	var err error
+	if user.Deleted() {
+		user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+			u.DeletedAt = nil
+			return nil
+		})
+		if err != nil {
+			jsonResponse(w, 500, "Failed to restore account")
+			return
+		}
+	}
+	accessTTL := cfg.authenticator.AccessLifetime(time.Duration(expiresInSeconds) * time.Second)
+	accessToken, err := user.GetAccessToken(cfg.authenticator, accessTTL)
+	if err != nil {
+		log.Printf("%v", err)
+		jsonResponse(w, 500, "Failed to generate access token")
+		return
+	}
+	client := requestClient(r)
+	if device != "" {
+		client.Device = device
+	}
+	refreshToken, err := cfg.db.CreateRefreshToken(user.ID, client, database.Grant{}, cfg.refreshTTL)
+	if err != nil {
+		log.Printf("%v", err)
+		jsonResponse(w, 500, "Failed to generate refresh token")
+		return
+	}
+	pl := payloads.LoginResponse{
+		Email:         user.Email,
+		EmailVerified: user.Verified(),
+		ID:            user.ID,
+		IsChirpyRed:   user.IsChirpyRed,
+		Token:         accessToken,
+		ExpiresIn:     int(accessTTL.Seconds()),
+		RefreshToken:  refreshToken,
+	}
+	metrics.Login(metrics.LoginSuccess)
+	jsonResponse(w, 200, pl)
+}
+
+// HandleUnlockUser lifts a login lockout on an account. The route checks
+// the caller's permission or admin API key.
+func (cfg *apiConfig) HandleUnlockUser(w http.ResponseWriter, r *http.Request) {
+	id, err := strconv.Atoi(r.PathValue("user_id"))
+	if err != nil {
+		errorResponse(w, 400, errors.New("bad id"))
+		return
+	}
+	user, err := cfg.db.GetUser(id)
+	if err != nil {
+		errorResponse(w, 404, err)
+		return
+	}
+	err = cfg.audit(r, "user.unlock", "user:"+strconv.Itoa(user.ID), "")
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not record unlock"))
+		return
+	}
+	cfg.loginAccounts.Reset(accountKey(user.Email))
+	w.WriteHeader(204)
+}
@@ -0,0 +1,378 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/oauth"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+// oauthCodeTTL is the lifetime of an authorization code, within the ten
+// minutes RFC 6749 section 4.1.2 allows.
+const oauthCodeTTL time.Duration = time.Minute * 5
+
+// errCodeMismatch rejects an authorization code exchanged with the wrong
+// redirect_uri or code_verifier.
+var errCodeMismatch = errors.New("redirect_uri or code_verifier does not match")
+
+func oauthError(w http.ResponseWriter, code int, errCode string, description string) {
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, code, payloads.OAuthErrorResponse{
+		Error:            errCode,
+		ErrorDescription: description,
+	})
+}
+
+func (cfg *apiConfig) HandleCreateOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.OAuthClientRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		errorResponse(w, 400, errors.New("name cannot be empty"))
+		return
+	}
+	if len(req.RedirectURIs) == 0 {
+		errorResponse(w, 400, errors.New("at least one redirect URI is required"))
+		return
+	}
+	for _, uri := range req.RedirectURIs {
+		err = oauth.ValidateRedirectURI(uri)
+		if err != nil {
+			errorResponse(w, 400, err)
+			return
+		}
+	}
+	if len(req.Scopes) == 0 {
+		errorResponse(w, 400, errors.New("at least one scope is required"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(auth.Scopes, scope) {
+			errorResponse(w, 400, errors.New("unknown scope "+scope+", expected one of "+strings.Join(auth.Scopes, ", ")))
+			return
+		}
+	}
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	secret, client, err := cfg.db.CreateOAuthClient(user.ID, req.Name, req.RedirectURIs, slices.Compact(scopes), req.Confidential)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not register client"))
+		return
+	}
+	pl := payloads.NewOAuthClientResponse(client)
+	pl.ClientSecret = secret
+	jsonResponse(w, 201, pl)
+}
+
+func (cfg *apiConfig) HandleGetOAuthClients(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	clients, err := cfg.db.GetOAuthClients(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load clients"))
+		return
+	}
+	pl := []payloads.OAuthClientResponse{}
+	for _, c := range clients {
+		pl = append(pl, payloads.NewOAuthClientResponse(&c))
+	}
+	jsonResponse(w, 200, pl)
+}
+
+// HandleDeleteOAuthClient unregisters a client, signing it out of every
+// account that authorized it.
+func (cfg *apiConfig) HandleDeleteOAuthClient(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	err = cfg.db.DeleteOAuthClient(user.ID, r.PathValue("client_id"))
+	if errors.Is(err, database.ErrOAuthClientNotFound) {
+		errorResponse(w, 404, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not delete client"))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// checkAuthorization validates an authorization request and returns the
+// client and the scopes it asks for. PKCE is required of every client.
+func (cfg *apiConfig) checkAuthorization(req payloads.OAuthAuthorizeRequest) (*database.OAuthClient, []string, *payloads.OAuthErrorResponse) {
+	client, err := cfg.db.GetOAuthClient(req.ClientID)
+	if err != nil {
+		return nil, nil, &payloads.OAuthErrorResponse{Error: oauth.ErrInvalidRequest, ErrorDescription: "unknown client_id"}
+	}
+	// never send anything to a URI the client did not register
+	if !slices.Contains(client.RedirectURIs, req.RedirectURI) {
+		return nil, nil, &payloads.OAuthErrorResponse{Error: oauth.ErrInvalidRequest, ErrorDescription: "redirect_uri is not registered for this client"}
+	}
+	if req.ResponseType != "code" {
+		return nil, nil, &payloads.OAuthErrorResponse{Error: oauth.ErrUnsupportedResponse, ErrorDescription: "response_type must be code"}
+	}
+	if req.CodeChallengeMethod != oauth.MethodS256 || !oauth.ValidChallenge(req.CodeChallenge) {
+		return nil, nil, &payloads.OAuthErrorResponse{Error: oauth.ErrInvalidRequest, ErrorDescription: "an S256 code_challenge is required"}
+	}
+	scopes := oauth.ParseScope(req.Scope)
+	if len(scopes) == 0 {
+		scopes = client.Scopes
+	}
+	for _, scope := range scopes {
+		if !slices.Contains(client.Scopes, scope) {
+			return nil, nil, &payloads.OAuthErrorResponse{Error: oauth.ErrInvalidScope, ErrorDescription: "client may not request " + scope}
+		}
+	}
+	return client, scopes, nil
+}
+
+// HandleOAuthConsent describes an authorization request so the signed-in
+// user can decide on it. The parameters are those of the client's
+// authorization URL.
+func (cfg *apiConfig) HandleOAuthConsent(w http.ResponseWriter, r *http.Request) {
+	_, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	q := r.URL.Query()
+	client, scopes, oerr := cfg.checkAuthorization(payloads.OAuthAuthorizeRequest{
+		ResponseType:        q.Get("response_type"),
+		ClientID:            q.Get("client_id"),
+		RedirectURI:         q.Get("redirect_uri"),
+		Scope:               q.Get("scope"),
+		State:               q.Get("state"),
+		CodeChallenge:       q.Get("code_challenge"),
+		CodeChallengeMethod: q.Get("code_challenge_method"),
+	})
+	if oerr != nil {
+		oauthError(w, 400, oerr.Error, oerr.ErrorDescription)
+		return
+	}
+	jsonResponse(w, 200, payloads.OAuthConsentResponse{
+		ClientID:    client.ID,
+		ClientName:  client.Name,
+		RedirectURI: q.Get("redirect_uri"),
+		Scopes:      scopes,
+	})
+}
+
+// HandleOAuthAuthorize records the user's decision and returns where to
+// send their browser: back to the client with a code, or with an error.
+func (cfg *apiConfig) HandleOAuthAuthorize(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.OAuthAuthorizeRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	client, scopes, oerr := cfg.checkAuthorization(req)
+	if oerr != nil {
+		oauthError(w, 400, oerr.Error, oerr.ErrorDescription)
+		return
+	}
+	params := url.Values{}
+	if req.State != "" {
+		params.Set("state", req.State)
+	}
+	if !req.Approve {
+		params.Set("error", oauth.ErrAccessDenied)
+		jsonResponse(w, 200, payloads.OAuthAuthorizeResponse{RedirectTo: oauth.RedirectWith(req.RedirectURI, params)})
+		return
+	}
+	grant := database.Grant{ClientID: client.ID, Scopes: scopes}
+	code, err := cfg.db.CreateOAuthCode(user.ID, grant, req.RedirectURI, req.CodeChallenge, oauthCodeTTL)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not create authorization code"))
+		return
+	}
+	params.Set("code", code)
+	jsonResponse(w, 200, payloads.OAuthAuthorizeResponse{RedirectTo: oauth.RedirectWith(req.RedirectURI, params)})
+}
+
+// sessionActive reports whether the session an OAuth client's access token
+// was issued from is still active. Other tokens have no session to check.
+func (cfg *apiConfig) sessionActive(p *auth.Principal) bool {
+	if p.SessionID == "" {
+		return true
+	}
+	active, err := cfg.db.SessionActive(p.UserID, p.SessionID)
+	if err != nil {
+		log.Printf("%v", err)
+		return false
+	}
+	return active
+}
+
+// authenticateClient identifies the client calling the token or
+// introspection endpoint, by HTTP Basic auth or form parameters. Public
+// clients identify themselves with client_id alone.
+func (cfg *apiConfig) authenticateClient(r *http.Request) (*database.OAuthClient, bool) {
+	id, secret, basic := r.BasicAuth()
+	if basic {
+		// RFC 6749 section 2.3.1 form-encodes the credentials
+		id, _ = url.QueryUnescape(id)
+		secret, _ = url.QueryUnescape(secret)
+	} else {
+		id = r.PostForm.Get("client_id")
+		secret = r.PostForm.Get("client_secret")
+	}
+	client, err := cfg.db.GetOAuthClient(id)
+	if err != nil {
+		return nil, false
+	}
+	if client.Confidential() {
+		return client, client.CheckSecret(secret)
+	}
+	return client, secret == ""
+}
+
+// HandleOAuthToken is the token endpoint, RFC 6749 section 3.2, for the
+// authorization_code and refresh_token grants.
+func (cfg *apiConfig) HandleOAuthToken(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, 400, oauth.ErrInvalidRequest, "body must be form-encoded")
+		return
+	}
+	client, ok := cfg.authenticateClient(r)
+	if !ok {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		oauthError(w, 401, oauth.ErrInvalidClient, "client authentication failed")
+		return
+	}
+	var userID int
+	var grant database.Grant
+	var session string
+	sessionClient := requestClient(r)
+	sessionClient.Device = client.Name
+	var refreshToken string
+	switch r.PostForm.Get("grant_type") {
+	case "authorization_code":
+		next, oc, err := cfg.db.ExchangeOAuthCode(r.PostForm.Get("code"), client.ID, sessionClient, cfg.refreshTTL, func(oc *database.OAuthCode) error {
+			if oc.RedirectURI != r.PostForm.Get("redirect_uri") || !oauth.VerifyPKCE(oc.CodeChallenge, r.PostForm.Get("code_verifier")) {
+				return errCodeMismatch
+			}
+			return nil
+		})
+		if errors.Is(err, errCodeMismatch) {
+			oauthError(w, 400, oauth.ErrInvalidGrant, "redirect_uri or code_verifier does not match")
+			return
+		}
+		if errors.Is(err, database.ErrOAuthCodeInvalid) || errors.Is(err, database.ErrOAuthCodeReused) {
+			oauthError(w, 400, oauth.ErrInvalidGrant, "authorization code is invalid or has expired")
+			return
+		}
+		if err != nil {
+			log.Printf("%v", err)
+			oauthError(w, 500, "server_error", "failed to generate refresh token")
+			return
+		}
+		userID, grant, session, refreshToken = oc.UserID, oc.Grant, oc.FamilyID, next
+	case "refresh_token":
+		next, rt, err := cfg.db.RotateRefreshToken(r.PostForm.Get("refresh_token"), client.ID, sessionClient, cfg.refreshTTL)
+		if err != nil {
+			oauthError(w, 400, oauth.ErrInvalidGrant, "refresh token is invalid")
+			return
+		}
+		userID, grant, session, refreshToken = rt.UserID, rt.Grant, rt.FamilyID, next
+	default:
+		oauthError(w, 400, oauth.ErrUnsupportedGrantType, "grant_type must be authorization_code or refresh_token")
+		return
+	}
+	user, err := cfg.db.GetUser(userID)
+	if err != nil || user.Deleted() {
+		oauthError(w, 400, oauth.ErrInvalidGrant, "the account is no longer available")
+		return
+	}
+	accessTTL := cfg.authenticator.AccessLifetime(0)
+	accessToken, err := user.GetDelegatedAccessToken(cfg.authenticator, session, grant, accessTTL)
+	if err != nil {
+		log.Printf("%v", err)
+		oauthError(w, 500, "server_error", "failed to generate access token")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	jsonResponse(w, 200, payloads.OAuthTokenResponse{
+		AccessToken:  accessToken,
+		TokenType:    "Bearer",
+		ExpiresIn:    int(accessTTL.Seconds()),
+		RefreshToken: refreshToken,
+		Scope:        strings.Join(grant.Scopes, " "),
+	})
+}
+
+// HandleOAuthIntrospect implements RFC 7662 for confidential clients. A
+// client only learns about tokens issued to itself; anything else is
+// reported inactive.
+func (cfg *apiConfig) HandleOAuthIntrospect(w http.ResponseWriter, r *http.Request) {
+	err := r.ParseForm()
+	if err != nil {
+		oauthError(w, 400, oauth.ErrInvalidRequest, "body must be form-encoded")
+		return
+	}
+	client, ok := cfg.authenticateClient(r)
+	if !ok || !client.Confidential() {
+		w.Header().Set("WWW-Authenticate", `Basic realm="chirpy"`)
+		oauthError(w, 401, oauth.ErrInvalidClient, "client authentication failed")
+		return
+	}
+	w.Header().Set("Cache-Control", "no-store")
+	token := r.PostForm.Get("token")
+	if p, err := cfg.authenticator.Verify(token, auth.TokenAccess); err == nil && p.ClientID == client.ID {
+		user, err := cfg.db.GetUser(p.UserID)
+		if err == nil && !user.Deleted() && !user.TokenRevoked(p.IssuedAt, p.TokenVersion) && cfg.sessionActive(p) {
+			jsonResponse(w, 200, payloads.IntrospectionResponse{
+				Active:    true,
+				Scope:     strings.Join(p.Scopes, " "),
+				ClientID:  p.ClientID,
+				Subject:   strconv.Itoa(p.UserID),
+				TokenType: "access_token",
+				ExpiresAt: p.ExpiresAt.Unix(),
+				IssuedAt:  p.IssuedAt.Unix(),
+			})
+			return
+		}
+	}
+	if rt, err := cfg.db.GetRefreshToken(token); err == nil && rt.ClientID == client.ID {
+		jsonResponse(w, 200, payloads.IntrospectionResponse{
+			Active:    true,
+			Scope:     strings.Join(rt.Scopes, " "),
+			ClientID:  rt.ClientID,
+			Subject:   strconv.Itoa(rt.UserID),
+			TokenType: "refresh_token",
+			ExpiresAt: rt.ExpiresAt.Unix(),
+			IssuedAt:  rt.CreatedAt.Unix(),
+		})
+		return
+	}
+	jsonResponse(w, 200, payloads.IntrospectionResponse{Active: false})
+}
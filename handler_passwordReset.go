@@ -0,0 +1,135 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+	"github.com/am1macdonald/chirpy/internal/throttle"
+)
+
+// passwordResetPolicy limits reset emails per address, so the endpoint
+// cannot be used to flood someone's inbox.
+var passwordResetPolicy = throttle.Policy{
+	FreeAttempts: 2,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	Window:       time.Hour * 24,
+}
+
+// HandlePasswordReset emails a reset token to the address given. The
+// response is the same whether or not the address belongs to an account,
+// and the email is sent after responding so timing gives nothing away.
+func (cfg *apiConfig) HandlePasswordReset(w http.ResponseWriter, r *http.Request) {
+	req := payloads.PasswordResetRequest{}
+	err := payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if !mail.ValidAddress(req.Email) {
+		errorResponse(w, 400, errors.New("invalid email address"))
+		return
+	}
+	key := accountKey(req.Email)
+	if _, ok := cfg.passwordResets.Allow(key); ok {
+		go cfg.sendPasswordReset(req.Email)
+	}
+	jsonResponse(w, 202, "if an account uses this address, a reset token has been sent to it")
+}
+
+func (cfg *apiConfig) sendPasswordReset(email string) {
+	user, err := cfg.db.GetUserByEmail(email)
+	if err != nil || user.Deleted() {
+		return
+	}
+	token, err := cfg.db.CreatePasswordReset(user.ID, user.Email, cfg.passwordResetTTL)
+	if err != nil {
+		log.Printf("Failed to create password reset for user %d: %v", user.ID, err)
+		return
+	}
+	err = cfg.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Reset your Chirpy password",
+		Body: fmt.Sprintf("Your password reset token is:\n\n%s\n\n"+
+			"Send it with your new password to POST %s/api/password-reset/confirm. "+
+			"It can be used once and expires in %v.\n\n"+
+			"If you did not ask to reset your password, you can ignore this email.\n",
+			token, cfg.publicURL, cfg.passwordResetTTL),
+	})
+	if err != nil {
+		log.Printf("Failed to send password reset email to user %d: %v", user.ID, err)
+	}
+}
+
+// HandlePasswordResetConfirm sets a new password with a reset token, signs
+// the user out everywhere and revokes their personal access tokens. Receiving the token also proves the user
+// owns their email address, provided it is still the one the token was
+// sent to.
+func (cfg *apiConfig) HandlePasswordResetConfirm(w http.ResponseWriter, r *http.Request) {
+	req := payloads.PasswordResetConfirmRequest{}
+	err := payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	// check the password first so a rejected one does not use up the token
+	err = cfg.passwords.Validate(req.NewPassword)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	pr, err := cfg.db.UsePasswordReset(req.Token)
+	if errors.Is(err, database.ErrPasswordResetInvalid) {
+		errorResponse(w, 400, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not reset password"))
+		return
+	}
+	hash, err := cfg.passwords.Hash(req.NewPassword)
+	if err != nil {
+		log.Println(err)
+		errorResponse(w, 500, errors.New("could not reset password"))
+		return
+	}
+	user, err := cfg.db.UpdateUser(pr.UserID, func(u *database.User) error {
+		// a token sent to an address the account no longer uses proves nothing
+		if u.Deleted() || pr.Email != u.Email {
+			return database.ErrPasswordResetInvalid
+		}
+		u.Password = hash
+		u.RevokeTokens(cfg.now())
+		// the token reached the current address, which proves the user owns it
+		u.EmailUnverified = false
+		return nil
+	})
+	if errors.Is(err, database.ErrPasswordResetInvalid) || errors.Is(err, database.ErrUserNotFound) {
+		errorResponse(w, 400, database.ErrPasswordResetInvalid)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	err = cfg.db.RevokeUserRefreshTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke sessions"))
+		return
+	}
+	// a reset recovers the account, so tokens someone else may have
+	// created with it go too
+	err = cfg.db.DeletePersonalTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke personal access tokens"))
+		return
+	}
+	cfg.loginAccounts.Reset(accountKey(user.Email))
+	w.WriteHeader(http.StatusNoContent)
+}
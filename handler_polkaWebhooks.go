@@ -1,11 +1,13 @@
 package main
 
 import (
+	"crypto/subtle"
 	"errors"
 	"log"
 	"net/http"
-	"strings"
 
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
 	"github.com/am1macdonald/chirpy/internal/payloads"
 )
 
@@ -17,18 +19,13 @@ type polkaWebhookBody struct {
 }
 
 func (cfg *apiConfig) HandlePolkaWebhook(w http.ResponseWriter, r *http.Request) {
-	ts := r.Header.Get("Authorization")
-	if ts == "" {
-		errorResponse(w, 401, errors.New("api token required"))
-		return
-	}
-	auth := strings.Split(ts, " ")
-	if auth[0] != "ApiKey" || auth[1] != config.polkaKey {
+	key, err := auth.ParseAuthorization(r.Header, "ApiKey")
+	if err != nil || subtle.ConstantTimeCompare([]byte(key), []byte(cfg.polkaKey)) != 1 {
 		errorResponse(w, 401, errors.New("api token required"))
 		return
 	}
 	req := polkaWebhookBody{}
-	err := payloads.DecodeRequest(r, &req)
+	err = payloads.DecodeRequest(r, &req)
 	if err != nil {
 		errorResponse(w, 500, err)
 		return
@@ -38,13 +35,14 @@ func (cfg *apiConfig) HandlePolkaWebhook(w http.ResponseWriter, r *http.Request)
 		jsonResponse(w, 200, "success")
 		return
 	}
-	user, err := db.GetUser(req.Data.UserID)
-	if err != nil {
+	_, err = cfg.db.UpdateUser(req.Data.UserID, func(u *database.User) error {
+		u.IsChirpyRed = true
+		return nil
+	})
+	if errors.Is(err, database.ErrUserNotFound) {
 		errorResponse(w, 404, err)
 		return
 	}
-	user.IsChirpyRed = true
-	user, err = db.UpdateUser(user)
 	if err != nil {
 		errorResponse(w, 500, err)
 		return
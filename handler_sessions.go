@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+func (cfg *apiConfig) HandleGetSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	sessions, err := cfg.db.GetSessions(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load sessions"))
+		return
+	}
+	pl := []payloads.SessionResponse{}
+	for _, s := range sessions {
+		pl = append(pl, payloads.NewSessionResponse(s))
+	}
+	jsonResponse(w, 200, pl)
+}
+
+func (cfg *apiConfig) HandleRevokeSession(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	err = cfg.db.RevokeSession(user.ID, r.PathValue("session_id"))
+	if errors.Is(err, database.ErrSessionNotFound) {
+		errorResponse(w, 404, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke session"))
+		return
+	}
+	w.WriteHeader(204)
+}
+
+// HandleRevokeAllSessions logs the user out everywhere, including the
+// access token used to make the request.
+func (cfg *apiConfig) HandleRevokeAllSessions(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	_, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		u.RevokeTokens(cfg.now())
+		return nil
+	})
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	err = cfg.db.RevokeUserRefreshTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke sessions"))
+		return
+	}
+	w.WriteHeader(204)
+}
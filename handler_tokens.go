@@ -0,0 +1,120 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+// verifyPersonalToken authenticates requests made with a personal access
+// token. Tokens keep working across logouts and password changes, until
+// they expire or are revoked, but do not survive a password reset or
+// outlive their account.
+func (cfg *apiConfig) verifyPersonalToken(token string) (*auth.Principal, error) {
+	pt, err := cfg.db.UsePersonalToken(token)
+	if err != nil {
+		return nil, auth.ErrInvalidToken
+	}
+	p := auth.Principal{
+		UserID:    pt.UserID,
+		TokenType: auth.TokenPersonal,
+		Token:     token,
+		Scopes:    pt.Scopes,
+	}
+	if pt.ExpiresAt != nil {
+		p.ExpiresAt = *pt.ExpiresAt
+	}
+	return &p, nil
+}
+
+func (cfg *apiConfig) HandleGetPersonalTokens(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	tokens, err := cfg.db.GetPersonalTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not load tokens"))
+		return
+	}
+	pl := []payloads.PersonalTokenResponse{}
+	for _, pt := range tokens {
+		pl = append(pl, payloads.NewPersonalTokenResponse(&pt))
+	}
+	jsonResponse(w, 200, pl)
+}
+
+// HandleCreatePersonalToken returns the new token's value, which cannot be
+// retrieved again.
+func (cfg *apiConfig) HandleCreatePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.PersonalTokenRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	req.Name = strings.TrimSpace(req.Name)
+	if req.Name == "" {
+		errorResponse(w, 400, errors.New("name cannot be empty"))
+		return
+	}
+	if len(req.Scopes) == 0 {
+		errorResponse(w, 400, errors.New("at least one scope is required"))
+		return
+	}
+	for _, scope := range req.Scopes {
+		if !slices.Contains(auth.Scopes, scope) {
+			errorResponse(w, 400, errors.New("unknown scope "+scope+", expected one of "+strings.Join(auth.Scopes, ", ")))
+			return
+		}
+	}
+	if req.ExpiresInSeconds < 0 {
+		errorResponse(w, 400, errors.New("expires_in_seconds cannot be negative"))
+		return
+	}
+	var expiresAt *time.Time
+	if req.ExpiresInSeconds > 0 {
+		t := cfg.now().Add(time.Duration(req.ExpiresInSeconds) * time.Second)
+		expiresAt = &t
+	}
+	scopes := slices.Clone(req.Scopes)
+	slices.Sort(scopes)
+	token, pt, err := cfg.db.CreatePersonalToken(user.ID, req.Name, slices.Compact(scopes), expiresAt)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not create token"))
+		return
+	}
+	pl := payloads.NewPersonalTokenResponse(pt)
+	pl.Token = token
+	jsonResponse(w, 201, pl)
+}
+
+func (cfg *apiConfig) HandleRevokePersonalToken(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	err = cfg.db.DeletePersonalToken(user.ID, r.PathValue("token_id"))
+	if errors.Is(err, database.ErrPersonalTokenNotFound) {
+		errorResponse(w, 404, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke token"))
+		return
+	}
+	w.WriteHeader(204)
+}
@@ -0,0 +1,248 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base32"
+	"errors"
+	"net/http"
+	"strings"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+	"github.com/am1macdonald/chirpy/internal/totp"
+)
+
+const (
+	totpIssuer        string = "Chirpy"
+	recoveryCodeCount int    = 10
+)
+
+// generateRecoveryCodes returns codes in the form "abcde-fghij", each with
+// 50 bits of randomness.
+func generateRecoveryCodes() ([]string, error) {
+	codes := []string{}
+	for i := 0; i < recoveryCodeCount; i++ {
+		b := make([]byte, 7)
+		_, err := rand.Read(b)
+		if err != nil {
+			return nil, err
+		}
+		s := strings.ToLower(base32.StdEncoding.EncodeToString(b))[:10]
+		codes = append(codes, s[:5]+"-"+s[5:])
+	}
+	return codes, nil
+}
+
+// normalizeRecoveryCode accepts a recovery code however it was typed.
+func normalizeRecoveryCode(code string) string {
+	return strings.NewReplacer("-", "", " ", "").Replace(strings.ToLower(code))
+}
+
+// HandleEnrolTOTP starts two-factor enrolment by generating a secret. It
+// takes effect once HandleConfirmTOTP has seen a code made with it.
+func (cfg *apiConfig) HandleEnrolTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.TOTPEnrolRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if !user.Validate(req.Password) {
+		errorResponse(w, 401, errors.New("password is incorrect"))
+		return
+	}
+	errEnabled := errors.New("two-factor authentication is already enabled")
+	if user.TwoFactorEnabled() {
+		errorResponse(w, 409, errEnabled)
+		return
+	}
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not generate secret"))
+		return
+	}
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		if u.TwoFactorEnabled() {
+			return errEnabled
+		}
+		u.TOTP = &database.TOTP{Secret: secret}
+		return nil
+	})
+	if errors.Is(err, errEnabled) {
+		errorResponse(w, 409, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	jsonResponse(w, 200, payloads.TOTPEnrolResponse{
+		Secret: secret,
+		URI:    totp.URI(totpIssuer, user.Email, secret),
+	})
+}
+
+// HandleConfirmTOTP enables two-factor authentication and returns the
+// recovery codes, which are only ever shown this once.
+func (cfg *apiConfig) HandleConfirmTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.TOTPCodeRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	errNoEnrolment := errors.New("no two-factor enrolment is in progress")
+	if user.TOTP == nil || user.TOTP.Enabled {
+		errorResponse(w, 409, errNoEnrolment)
+		return
+	}
+	counter, ok := totp.Validate(user.TOTP.Secret, req.Code, cfg.now())
+	if !ok {
+		errorResponse(w, 400, errors.New("invalid code"))
+		return
+	}
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not generate recovery codes"))
+		return
+	}
+	normalized := []string{}
+	for _, code := range codes {
+		normalized = append(normalized, normalizeRecoveryCode(code))
+	}
+	secret := user.TOTP.Secret
+	_, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		// the code was checked against this enrolment's secret
+		if u.TOTP == nil || u.TOTP.Enabled || u.TOTP.Secret != secret {
+			return errNoEnrolment
+		}
+		u.TOTP.Enabled = true
+		u.TOTP.LastCounter = counter
+		u.SetRecoveryCodes(normalized)
+		return nil
+	})
+	if errors.Is(err, errNoEnrolment) {
+		errorResponse(w, 409, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	jsonResponse(w, 200, payloads.RecoveryCodesResponse{RecoveryCodes: codes})
+}
+
+func (cfg *apiConfig) HandleDisableTOTP(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.TOTPDisableRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if !user.Validate(req.Password) {
+		errorResponse(w, 401, errors.New("password is incorrect"))
+		return
+	}
+	errDisabled := errors.New("two-factor authentication is not enabled")
+	if user.TOTP == nil {
+		errorResponse(w, 409, errDisabled)
+		return
+	}
+	_, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		if u.TOTP == nil {
+			return errDisabled
+		}
+		u.TOTP = nil
+		return nil
+	})
+	if errors.Is(err, errDisabled) {
+		errorResponse(w, 409, err)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// HandleLoginTOTP exchanges the challenge from a password login and a TOTP
+// or recovery code for access and refresh tokens. Wrong codes count against
+// the same login throttle as wrong passwords.
+func (cfg *apiConfig) HandleLoginTOTP(w http.ResponseWriter, r *http.Request) {
+	req := payloads.LoginTOTPRequest{}
+	err := payloads.DecodeRequest(r, &req)
+	if err != nil {
+		jsonResponse(w, 400, err.Error())
+		return
+	}
+	errChallenge := errors.New("login challenge is invalid or has expired")
+	p, err := cfg.authenticator.Verify(req.ChallengeToken, auth.TokenMFA)
+	if err != nil || p.TokenID == "" {
+		jsonResponse(w, 401, errChallenge.Error())
+		return
+	}
+	user, err := cfg.db.GetUser(p.UserID)
+	// changing the password or signing out everywhere voids open challenges
+	if err != nil || user.TokenRevoked(p.IssuedAt, p.TokenVersion) || !user.TwoFactorEnabled() {
+		jsonResponse(w, 401, errChallenge.Error())
+		return
+	}
+	account := accountKey(user.Email)
+	ip := clientIP(r)
+	if !cfg.allowLogin(w, account, ip) {
+		return
+	}
+	// a challenge logs in once, however many codes are sent with it, and
+	// the code is used up along with it so concurrent logins cannot both
+	// spend it
+	errCode := errors.New("invalid code")
+	user, err = cfg.db.UseLoginChallenge(p.TokenID, p.ExpiresAt, user.ID, func(u *database.User) error {
+		if u.TokenRevoked(p.IssuedAt, p.TokenVersion) || !u.TwoFactorEnabled() {
+			return errChallenge
+		}
+		counter, ok := totp.Validate(u.TOTP.Secret, strings.ReplaceAll(req.Code, " ", ""), cfg.now())
+		switch {
+		case ok && counter > u.TOTP.LastCounter:
+			u.TOTP.LastCounter = counter
+		case u.UseRecoveryCode(normalizeRecoveryCode(req.Code)):
+		default:
+			return errCode
+		}
+		return nil
+	})
+	if errors.Is(err, errCode) {
+		// the attempts were counted when they were allowed
+		metrics.Login(metrics.LoginMFAFailure)
+		jsonResponse(w, 401, errCode.Error())
+		return
+	}
+	if errors.Is(err, errChallenge) || errors.Is(err, database.ErrChallengeUsed) || errors.Is(err, database.ErrUserNotFound) {
+		jsonResponse(w, 401, errChallenge.Error())
+		return
+	}
+	if err != nil {
+		jsonResponse(w, 500, "Could not update user")
+		return
+	}
+	cfg.loginIPs.Release(ip)
+	cfg.loginAccounts.Reset(account)
+	cfg.completeLogin(w, r, user, req.Device, req.ExpiresInSeconds)
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+var errPasswordChanged = errors.New("the password was changed by another request")
+
+// checkEmail returns the status code to respond with when email cannot be
+// given to an account.
+func checkEmail(email string) (int, error) {
+	if email == "" {
+		return 400, errors.New("email cannot be empty")
+	}
+	if !mail.ValidAddress(email) {
+		return 400, errors.New("invalid email address")
+	}
+	return 200, nil
+}
+
+// setEmail gives the user a new email, which needs verifying again; once
+// the user is saved the caller calls startVerification.
+func setEmail(u *database.User, email string) {
+	email = mail.Normalize(email)
+	if email == u.Email {
+		return
+	}
+	u.Email = email
+	u.EmailUnverified = true
+}
+
+// confirmPassword returns the status code to respond with when current is
+// not the user's password. Changing the email or the password asks for it,
+// as either could hand the account to whoever holds a stolen access token.
+func confirmPassword(user *database.User, current string) (int, error) {
+	if !user.Validate(current) {
+		return 401, errors.New("current password is incorrect")
+	}
+	return 200, nil
+}
+
+// changePassword hashes a new password, returning the status code to
+// respond with when it cannot. The caller confirms the current password
+// first, then saves the hash with setPassword and revokes the user's
+// refresh tokens.
+func (cfg *apiConfig) changePassword(password string) (string, int, error) {
+	if password == "" {
+		return "", 400, errors.New("new password cannot be empty")
+	}
+	err := cfg.passwords.Validate(password)
+	if err != nil {
+		return "", 400, err
+	}
+	hash, err := cfg.passwords.Hash(password)
+	if err != nil {
+		log.Println(err)
+		return "", 500, errors.New("failed to update password")
+	}
+	return hash, 200, nil
+}
+
+// setPassword replaces the password hash read as old and revokes the access
+// tokens issued with it. The current password was checked against old, so
+// the change fails if another request has replaced it since.
+func (cfg *apiConfig) setPassword(u *database.User, old string, hash string) error {
+	if u.Password != old {
+		return errPasswordChanged
+	}
+	u.Password = hash
+	u.RevokeTokens(cfg.now())
+	return nil
+}
+
+// updateUserFailed responds to a change to a user that could not be saved.
+func updateUserFailed(w http.ResponseWriter, err error) {
+	switch {
+	case errors.Is(err, database.ErrUserNotFound):
+		errorResponse(w, 404, err)
+	case errors.Is(err, database.ErrEmailInUse), errors.Is(err, errPasswordChanged):
+		errorResponse(w, 409, err)
+	default:
+		log.Println(err)
+		errorResponse(w, 500, errors.New("could not update user"))
+	}
+}
+
+func (cfg *apiConfig) HandleGetMe(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	jsonResponse(w, 200, payloads.NewPrivateUser(user))
+}
+
+func (cfg *apiConfig) HandlePatchMe(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.UserPatchRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if req.Password != nil {
+		errorResponse(w, 400, errors.New("use PUT /api/users/me/password to change the password"))
+		return
+	}
+	if req.Email != nil {
+		// an email change could hand the account over through a password
+		// reset, so it takes a login rather than a delegated token
+		if p, _ := auth.PrincipalFrom(r.Context()); p.Delegated() {
+			errorResponse(w, 403, errors.New("only a login can change the email"))
+			return
+		}
+		code, err := checkEmail(*req.Email)
+		if err != nil {
+			errorResponse(w, code, err)
+			return
+		}
+		code, err = confirmPassword(user, req.CurrentPassword)
+		if err != nil {
+			errorResponse(w, code, err)
+			return
+		}
+	}
+	if req.Settings != nil && req.Settings.DefaultChirpSort != nil {
+		sort := *req.Settings.DefaultChirpSort
+		if sort != "asc" && sort != "desc" {
+			errorResponse(w, 400, errors.New("default_chirp_sort must be asc or desc"))
+			return
+		}
+	}
+	oldEmail := user.Email
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		if req.Email != nil {
+			setEmail(u, *req.Email)
+		}
+		if req.Settings != nil && req.Settings.DefaultChirpSort != nil {
+			u.Settings.DefaultChirpSort = *req.Settings.DefaultChirpSort
+		}
+		return nil
+	})
+	if err != nil {
+		updateUserFailed(w, err)
+		return
+	}
+	if user.Email != oldEmail {
+		cfg.startVerification(user)
+	}
+	jsonResponse(w, 200, payloads.NewPrivateUser(user))
+}
+
+func (cfg *apiConfig) HandleChangeEmail(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.EmailChangeRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	code, err := checkEmail(req.Email)
+	if err != nil {
+		errorResponse(w, code, err)
+		return
+	}
+	code, err = confirmPassword(user, req.CurrentPassword)
+	if err != nil {
+		errorResponse(w, code, err)
+		return
+	}
+	oldEmail := user.Email
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		setEmail(u, req.Email)
+		return nil
+	})
+	if err != nil {
+		updateUserFailed(w, err)
+		return
+	}
+	if user.Email != oldEmail {
+		cfg.startVerification(user)
+	}
+	jsonResponse(w, 200, payloads.NewPrivateUser(user))
+}
+
+func (cfg *apiConfig) HandleChangePassword(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.PasswordChangeRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	code, err := confirmPassword(user, req.CurrentPassword)
+	if err != nil {
+		errorResponse(w, code, err)
+		return
+	}
+	hash, code, err := cfg.changePassword(req.NewPassword)
+	if err != nil {
+		errorResponse(w, code, err)
+		return
+	}
+	old := user.Password
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		return cfg.setPassword(u, old, hash)
+	})
+	if err != nil {
+		updateUserFailed(w, err)
+		return
+	}
+	err = cfg.db.RevokeUserRefreshTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke refresh tokens"))
+		return
+	}
+	jsonResponse(w, 200, payloads.NewPrivateUser(user))
+}
+
+func (cfg *apiConfig) HandleDeleteMe(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	req := payloads.DeleteAccountRequest{}
+	err = payloads.DecodeRequest(r, &req)
+	if err != nil {
+		errorResponse(w, 400, err)
+		return
+	}
+	if !user.Validate(req.Password) {
+		errorResponse(w, 401, errors.New("password is incorrect"))
+		return
+	}
+	now := cfg.now()
+	user, err = cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		u.DeletedAt = &now
+		u.RevokeTokens(now)
+		return nil
+	})
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not delete user"))
+		return
+	}
+	err = cfg.db.RevokeUserRefreshTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke refresh tokens"))
+		return
+	}
+	// restoring the account does not bring personal access tokens back
+	err = cfg.db.DeletePersonalTokens(user.ID)
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not revoke personal access tokens"))
+		return
+	}
+	jsonResponse(w, 202, payloads.DeleteAccountResponse{
+		PurgeAt: now.Add(cfg.deletionGrace),
+	})
+}
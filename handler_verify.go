@@ -0,0 +1,124 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/throttle"
+)
+
+var errUnverified = errors.New("verify your email address first")
+
+// verificationPolicy spaces out verification emails per user: the link sent
+// at signup and one resend go out at once, later resends wait longer each time.
+var verificationPolicy = throttle.Policy{
+	FreeAttempts: 1,
+	BaseDelay:    time.Minute,
+	MaxDelay:     time.Hour,
+	Window:       time.Hour * 24,
+}
+
+// sendVerification emails the user a signed link confirming their address.
+// When the user has had too many links recently nothing is sent and the
+// wait before the next one is returned.
+func (cfg *apiConfig) sendVerification(user *database.User) (time.Duration, error) {
+	key := strconv.Itoa(user.ID)
+	wait, ok := cfg.verifications.Allow(key)
+	if !ok {
+		return wait, nil
+	}
+	ts, err := cfg.authenticator.IssueVerifyEmail(user.ID, user.Email)
+	if err != nil {
+		cfg.verifications.Release(key)
+		return 0, err
+	}
+	link := cfg.publicURL + "/api/verify-email?token=" + url.QueryEscape(ts)
+	err = cfg.mailer.Send(mail.Message{
+		To:      user.Email,
+		Subject: "Confirm your Chirpy email address",
+		Body: "Follow this link to confirm your email address:\n\n" + link +
+			"\n\nIf you did not sign up for Chirpy, you can ignore this email.\n",
+	})
+	if err != nil {
+		// a link that was never sent does not count
+		cfg.verifications.Release(key)
+		return 0, err
+	}
+	return 0, nil
+}
+
+// startVerification sends the first link after signup or an email change.
+// A failure is only logged, as the user can ask for another link.
+func (cfg *apiConfig) startVerification(user *database.User) {
+	wait, err := cfg.sendVerification(user)
+	if err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+	} else if wait > 0 {
+		log.Printf("Not sending verification email to user %d for another %v", user.ID, wait)
+	}
+}
+
+func (cfg *apiConfig) HandleResendVerification(w http.ResponseWriter, r *http.Request) {
+	user, err := cfg.currentUser(r)
+	if err != nil {
+		errorResponse(w, 401, err)
+		return
+	}
+	if user.Verified() {
+		errorResponse(w, 409, errors.New("email is already verified"))
+		return
+	}
+	wait, err := cfg.sendVerification(user)
+	if err != nil {
+		log.Printf("Failed to send verification email to user %d: %v", user.ID, err)
+		errorResponse(w, 500, errors.New("could not send verification email"))
+		return
+	}
+	if wait > 0 {
+		w.Header().Set("Retry-After", strconv.Itoa(int(math.Ceil(wait.Seconds()))))
+		errorResponse(w, 429, errors.New("a verification email was sent recently, try again later"))
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// HandleVerifyEmail is the target of the emailed link. The link only
+// confirms the address it was sent to, so it stops working if the email
+// changes in the meantime.
+func (cfg *apiConfig) HandleVerifyEmail(w http.ResponseWriter, r *http.Request) {
+	errInvalid := errors.New("verification link is invalid or has expired")
+	p, err := cfg.authenticator.Verify(r.URL.Query().Get("token"), auth.TokenVerifyEmail)
+	if err != nil {
+		errorResponse(w, 400, errInvalid)
+		return
+	}
+	verified := false
+	_, err = cfg.db.UpdateUser(p.UserID, func(u *database.User) error {
+		if u.Deleted() || u.Email != p.Email {
+			return errInvalid
+		}
+		verified = !u.Verified()
+		u.EmailUnverified = false
+		return nil
+	})
+	if errors.Is(err, errInvalid) || errors.Is(err, database.ErrUserNotFound) {
+		errorResponse(w, 400, errInvalid)
+		return
+	}
+	if err != nil {
+		errorResponse(w, 500, errors.New("could not update user"))
+		return
+	}
+	if verified {
+		cfg.verifications.Reset(strconv.Itoa(p.UserID))
+	}
+	jsonResponse(w, 200, "email verified")
+}
@@ -0,0 +1,529 @@
+package auth
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Token types, carried in the typ claim. Every route declares the one it
+// accepts; Public routes accept none.
+const (
+	Public      string = ""
+	TokenAccess string = "access"
+	// TokenVerifyEmail is sent in email verification links
+	TokenVerifyEmail string = "verify_email"
+	// TokenMFA is the challenge a password login returns when the account
+	// has two-factor authentication, exchanged with a code for real tokens
+	TokenMFA string = "mfa"
+	// TokenPersonal marks principals authenticated by a personal access
+	// token rather than a JWT
+	TokenPersonal string = "personal"
+)
+
+// PersonalTokenPrefix starts every personal access token, telling them
+// apart from JWTs and making leaked ones easy to scan for.
+const PersonalTokenPrefix string = "chirpy_pat_"
+
+// Scopes a personal access token can be granted. Access tokens from a login
+// carry every scope. Chirps can be read without any token today, so
+// chirps:read only matters once some of them are not public.
+const (
+	ScopeChirpsRead   string = "chirps:read"
+	ScopeChirpsWrite  string = "chirps:write"
+	ScopeProfileRead  string = "profile:read"
+	ScopeProfileWrite string = "profile:write"
+)
+
+var Scopes = []string{ScopeChirpsRead, ScopeChirpsWrite, ScopeProfileRead, ScopeProfileWrite}
+
+// Roles a user can hold. Users without a role are plain users, and their
+// tokens carry no role claim.
+const (
+	RoleUser      string = "user"
+	RoleModerator string = "moderator"
+	RoleAdmin     string = "admin"
+)
+
+var Roles = []string{RoleUser, RoleModerator, RoleAdmin}
+
+// Permissions are granted to roles and checked per route or, where they
+// depend on the resource, by the handler.
+const (
+	// PermModerateChirps allows deleting any user's chirps
+	PermModerateChirps string = "chirps:moderate"
+	// PermManageUsers allows changing roles and unlocking accounts
+	PermManageUsers string = "users:manage"
+	// PermViewMetrics allows reading the admin metrics
+	PermViewMetrics string = "metrics:read"
+	// PermReset allows resetting server state
+	PermReset string = "reset"
+	// PermViewAudit allows reading the audit log
+	PermViewAudit string = "audit:read"
+)
+
+var rolePermissions = map[string][]string{
+	RoleModerator: {PermModerateChirps},
+	RoleAdmin:     {PermModerateChirps, PermManageUsers, PermViewMetrics, PermReset, PermViewAudit},
+}
+
+// RoleCan reports whether role grants permission.
+func RoleCan(role string, permission string) bool {
+	return slices.Contains(rolePermissions[role], permission)
+}
+
+// TokenConfig controls the claims and lifetimes of issued tokens.
+type TokenConfig struct {
+	Issuer string
+	// Audience of access tokens
+	Audience string
+	// AccessLifetime is the longest an access token may live
+	AccessLifetime time.Duration
+	// VerifyEmailLifetime is how long an email verification link works
+	VerifyEmailLifetime time.Duration
+	// MFALifetime is how long a login challenge waits for its code
+	MFALifetime time.Duration
+	// Leeway tolerates clock skew when checking exp, iat and nbf
+	Leeway time.Duration
+	// Now is the clock tokens are issued and checked by, time.Now when nil
+	Now func() time.Time
+}
+
+func DefaultTokenConfig() TokenConfig {
+	return TokenConfig{
+		Issuer:              "chirpy",
+		Audience:            "chirpy-api",
+		AccessLifetime:      time.Hour,
+		VerifyEmailLifetime: time.Hour * 24,
+		MFALifetime:         time.Minute * 5,
+	}
+}
+
+// Claims are the claims of every token Chirpy issues.
+type Claims struct {
+	jwt.RegisteredClaims
+	Type string `json:"typ"`
+	// Email is the address a verification token confirms
+	Email string `json:"email,omitempty"`
+	// ClientID and Scope restrict access tokens issued to OAuth clients;
+	// Scope is space-separated as in RFC 9068
+	ClientID string `json:"client_id,omitempty"`
+	Scope    string `json:"scope,omitempty"`
+	// Role of the user when the access token was issued
+	Role string `json:"role,omitempty"`
+	// Version is the user's token version when the token was issued; signing
+	// out everywhere moves it on, revoking every token carrying an older one
+	Version int `json:"ver,omitempty"`
+	// SessionID is the refresh token family an OAuth client's access token
+	// was issued from; revoking the family revokes the token
+	SessionID string `json:"sid,omitempty"`
+}
+
+var (
+	ErrMissingHeader   = errors.New("Authorization header is required")
+	ErrMalformedHeader = errors.New("malformed Authorization header")
+	ErrInvalidToken    = errors.New("invalid token")
+	ErrWrongTokenType  = errors.New("wrong token type")
+	ErrMissingScope    = errors.New("token lacks the required scope")
+	ErrForbidden       = errors.New("permission denied")
+)
+
+// Principal is the authenticated caller of a request.
+type Principal struct {
+	UserID    int
+	TokenType string
+	Token     string
+	IssuedAt  time.Time
+	ExpiresAt time.Time
+	// Email is set for TokenVerifyEmail tokens
+	Email string
+	// ClientID is set when an OAuth client acts for the user
+	ClientID string
+	// Scopes are set for TokenPersonal principals and OAuth clients
+	Scopes []string
+	// Role is the user's role, empty for plain users and delegated principals
+	Role string
+	// TokenVersion is the user's token version the token was issued with
+	TokenVersion int
+	// SessionID is set for OAuth clients, naming the session the token
+	// belongs to
+	SessionID string
+	// TokenID is the jti of login challenges, which may only be used once
+	TokenID string
+}
+
+// Delegated reports whether the principal acts for the user with limited
+// scopes, rather than being the user after a login.
+func (p *Principal) Delegated() bool {
+	return p.TokenType == TokenPersonal || p.ClientID != ""
+}
+
+// HasScope reports whether the principal may act within scope.
+func (p *Principal) HasScope(scope string) bool {
+	if !p.Delegated() {
+		return p.TokenType == TokenAccess
+	}
+	return slices.Contains(p.Scopes, scope)
+}
+
+// Can reports whether the principal's role grants permission. Delegated
+// principals never act with the user's role.
+func (p *Principal) Can(permission string) bool {
+	return !p.Delegated() && RoleCan(p.Role, permission)
+}
+
+type contextKey struct{}
+
+func WithPrincipal(ctx context.Context, p *Principal) context.Context {
+	return context.WithValue(ctx, contextKey{}, p)
+}
+
+// PrincipalFrom returns the principal stored by the middleware, if any.
+func PrincipalFrom(ctx context.Context) (*Principal, bool) {
+	p, ok := ctx.Value(contextKey{}).(*Principal)
+	return p, ok && p != nil
+}
+
+// ParseAuthorization returns the credentials of an Authorization header
+// using the given scheme, e.g. "Bearer <token>". The scheme is matched
+// case-insensitively and the credentials must be a single non-empty word.
+func ParseAuthorization(h http.Header, scheme string) (string, error) {
+	v := h.Get("Authorization")
+	if v == "" {
+		return "", ErrMissingHeader
+	}
+	fields := strings.Fields(v)
+	if len(fields) != 2 || !strings.EqualFold(fields[0], scheme) {
+		return "", ErrMalformedHeader
+	}
+	return fields[1], nil
+}
+
+func BearerToken(h http.Header) (string, error) {
+	return ParseAuthorization(h, "Bearer")
+}
+
+// Authenticator issues and verifies Chirpy JWTs with the keys of a KeyRing.
+type Authenticator struct {
+	mu   sync.RWMutex
+	ring *KeyRing
+	cfg  TokenConfig
+	// personal verifies personal access tokens, which live in the database
+	personal func(token string) (*Principal, error)
+}
+
+func NewAuthenticator(ring *KeyRing, cfg TokenConfig) *Authenticator {
+	if cfg.Now == nil {
+		cfg.Now = time.Now
+	}
+	return &Authenticator{
+		ring: ring,
+		cfg:  cfg,
+	}
+}
+
+// audience maps each token type to the audience it is issued for, so a
+// token of one type cannot be replayed where another is expected.
+func (a *Authenticator) audience(tokenType string) (string, bool) {
+	switch tokenType {
+	case TokenAccess:
+		return a.cfg.Audience, true
+	case TokenVerifyEmail, TokenMFA:
+		// only Chirpy itself consumes these
+		return a.cfg.Issuer, true
+	}
+	return "", false
+}
+
+// AccessLifetime is how long a new access token lives: the requested
+// duration if there is one, capped at the configured maximum.
+func (a *Authenticator) AccessLifetime(requested time.Duration) time.Duration {
+	if requested <= 0 || requested > a.cfg.AccessLifetime {
+		return a.cfg.AccessLifetime
+	}
+	return requested
+}
+
+// MaxLifetime is the longest any token can remain valid. A key retired for
+// longer verifies nothing.
+func (a *Authenticator) MaxLifetime() time.Duration {
+	return max(a.cfg.AccessLifetime, a.cfg.VerifyEmailLifetime, a.cfg.MFALifetime) + a.cfg.Leeway
+}
+
+// SetPersonalTokenVerifier enables personal access tokens on routes
+// protected with RequireScope.
+func (a *Authenticator) SetPersonalTokenVerifier(verify func(token string) (*Principal, error)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.personal = verify
+}
+
+// SetKeyRing swaps in a new ring, e.g. after a rotation on disk.
+func (a *Authenticator) SetKeyRing(ring *KeyRing) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.ring = ring
+}
+
+func (a *Authenticator) keyRing() *KeyRing {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.ring
+}
+
+// keyFunc only hands out a key for tokens whose kid names a usable key and
+// whose alg matches it, so a token can never pick its own verification
+// algorithm.
+func (a *Authenticator) keyFunc(t *jwt.Token) (interface{}, error) {
+	kid, _ := t.Header["kid"].(string)
+	key, ok := a.keyRing().Lookup(kid, a.cfg.Now(), a.MaxLifetime())
+	if !ok || t.Method.Alg() != key.Method.Alg() {
+		return nil, ErrInvalidToken
+	}
+	return key.public, nil
+}
+
+// JWKS lists the public keys other services can verify tokens with.
+func (a *Authenticator) JWKS() JWKS {
+	set := JWKS{Keys: []JWK{}}
+	ring := a.keyRing()
+	now := a.cfg.Now()
+	for _, key := range ring.Keys() {
+		if _, ok := ring.Lookup(key.ID, now, a.MaxLifetime()); !ok {
+			continue
+		}
+		if jwk, ok := key.JWK(); ok {
+			set.Keys = append(set.Keys, jwk)
+		}
+	}
+	return set
+}
+
+// Issue signs a token of the given type for a user, valid for ttl.
+func (a *Authenticator) Issue(tokenType string, userID int, ttl time.Duration) (string, error) {
+	return a.issue(tokenType, userID, ttl, Claims{})
+}
+
+// IssueAccess signs an access token for a user holding role, at the user's
+// current token version.
+func (a *Authenticator) IssueAccess(userID int, version int, role string, ttl time.Duration) (string, error) {
+	return a.issue(TokenAccess, userID, ttl, Claims{Role: role, Version: version})
+}
+
+// IssueDelegated signs an access token for an OAuth client, limited to
+// scopes.
+func (a *Authenticator) IssueDelegated(userID int, version int, sessionID string, clientID string, scopes []string, ttl time.Duration) (string, error) {
+	return a.issue(TokenAccess, userID, ttl, Claims{ClientID: clientID, Scope: strings.Join(scopes, " "), Version: version, SessionID: sessionID})
+}
+
+// IssueVerifyEmail signs a token confirming that the user owns email. It
+// stops working once the user's email changes.
+func (a *Authenticator) IssueVerifyEmail(userID int, email string) (string, error) {
+	return a.issue(TokenVerifyEmail, userID, a.cfg.VerifyEmailLifetime, Claims{Email: email})
+}
+
+// IssueMFAChallenge signs the challenge returned by a password login that
+// still needs a second factor. Each challenge gets its own jti, so that the
+// caller can refuse to accept it twice.
+func (a *Authenticator) IssueMFAChallenge(userID int, version int) (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	claims := Claims{Version: version}
+	claims.ID = base64.RawURLEncoding.EncodeToString(b)
+	return a.issue(TokenMFA, userID, a.cfg.MFALifetime, claims)
+}
+
+// MFALifetime is how long a login challenge lives.
+func (a *Authenticator) MFALifetime() time.Duration {
+	return a.cfg.MFALifetime
+}
+
+// issue signs a token with the registered claims filled in on top of the
+// custom ones in claims.
+func (a *Authenticator) issue(tokenType string, userID int, ttl time.Duration, claims Claims) (string, error) {
+	aud, ok := a.audience(tokenType)
+	if !ok {
+		return "", ErrWrongTokenType
+	}
+	now := a.cfg.Now()
+	claims.RegisteredClaims = jwt.RegisteredClaims{
+		ExpiresAt: jwt.NewNumericDate(now.Add(ttl)),
+		Issuer:    a.cfg.Issuer,
+		Audience:  jwt.ClaimStrings{aud},
+		IssuedAt:  jwt.NewNumericDate(now),
+		Subject:   strconv.Itoa(userID),
+		ID:        claims.ID,
+	}
+	claims.Type = tokenType
+	key := a.keyRing().Active()
+	t := jwt.NewWithClaims(key.Method, &claims)
+	t.Header["kid"] = key.ID
+	return t.SignedString(key.private)
+}
+
+// Verify checks the signature, expiry, issuer, audience and type of a token
+// and returns the principal it identifies.
+func (a *Authenticator) Verify(ts string, tokenType string) (*Principal, error) {
+	aud, ok := a.audience(tokenType)
+	if !ok {
+		return nil, ErrWrongTokenType
+	}
+	claims := Claims{}
+	_, err := jwt.ParseWithClaims(ts, &claims, a.keyFunc,
+		jwt.WithExpirationRequired(), jwt.WithIssuedAt(), jwt.WithIssuer(a.cfg.Issuer),
+		jwt.WithLeeway(a.cfg.Leeway), jwt.WithTimeFunc(a.cfg.Now))
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	// check the type before the audience so a misused token reports why
+	if claims.Type != tokenType {
+		return nil, ErrWrongTokenType
+	}
+	if !slices.Contains(claims.Audience, aud) {
+		return nil, ErrInvalidToken
+	}
+	id, err := strconv.Atoi(claims.Subject)
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	p := Principal{
+		UserID:       id,
+		TokenType:    claims.Type,
+		Token:        ts,
+		ExpiresAt:    claims.ExpiresAt.Time,
+		Email:        claims.Email,
+		ClientID:     claims.ClientID,
+		Role:         claims.Role,
+		TokenVersion: claims.Version,
+		SessionID:    claims.SessionID,
+		TokenID:      claims.ID,
+	}
+	if claims.Scope != "" {
+		p.Scopes = strings.Fields(claims.Scope)
+	}
+	if claims.IssuedAt != nil {
+		p.IssuedAt = claims.IssuedAt.Time
+	}
+	return &p, nil
+}
+
+// Require only lets requests through that carry a valid bearer token of the
+// given type, and makes its principal available through PrincipalFrom.
+func (a *Authenticator) Require(tokenType string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts, err := BearerToken(r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if strings.HasPrefix(ts, PersonalTokenPrefix) {
+			http.Error(w, ErrWrongTokenType.Error(), http.StatusUnauthorized)
+			return
+		}
+		p, err := a.Verify(ts, tokenType)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if p.Delegated() {
+			http.Error(w, ErrMissingScope.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+func (a *Authenticator) RequireFunc(tokenType string, next http.HandlerFunc) http.HandlerFunc {
+	return a.Require(tokenType, next).ServeHTTP
+}
+
+// RequireScope is Require(TokenAccess, next) that also accepts personal
+// access tokens and OAuth client tokens granted scope. Routes protected with
+// plain Require, such as account management, accept neither.
+func (a *Authenticator) RequireScope(scope string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts, err := BearerToken(r.Header)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		var p *Principal
+		if strings.HasPrefix(ts, PersonalTokenPrefix) {
+			a.mu.RLock()
+			verify := a.personal
+			a.mu.RUnlock()
+			if verify == nil {
+				http.Error(w, ErrInvalidToken.Error(), http.StatusUnauthorized)
+				return
+			}
+			p, err = verify(ts)
+		} else {
+			p, err = a.Verify(ts, TokenAccess)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnauthorized)
+			return
+		}
+		if !p.HasScope(scope) {
+			http.Error(w, ErrMissingScope.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+func (a *Authenticator) RequireScopeFunc(scope string, next http.HandlerFunc) http.HandlerFunc {
+	return a.RequireScope(scope, next).ServeHTTP
+}
+
+// Optional lets every request through, like a public route, and makes the
+// principal of a valid first-party access token available through
+// PrincipalFrom. Other tokens are ignored, as the route needs none.
+func (a *Authenticator) Optional(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ts, err := BearerToken(r.Header)
+		if err != nil || strings.HasPrefix(ts, PersonalTokenPrefix) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		p, err := a.Verify(ts, TokenAccess)
+		if err != nil || p.Delegated() {
+			next.ServeHTTP(w, r)
+			return
+		}
+		next.ServeHTTP(w, r.WithContext(WithPrincipal(r.Context(), p)))
+	})
+}
+
+func (a *Authenticator) OptionalFunc(next http.HandlerFunc) http.HandlerFunc {
+	return a.Optional(next).ServeHTTP
+}
+
+// RequirePermission is Require(TokenAccess, next) for users whose role
+// grants permission.
+func (a *Authenticator) RequirePermission(permission string, next http.Handler) http.Handler {
+	return a.Require(TokenAccess, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, _ := PrincipalFrom(r.Context())
+		if !p.Can(permission) {
+			http.Error(w, ErrForbidden.Error(), http.StatusForbidden)
+			return
+		}
+		next.ServeHTTP(w, r)
+	}))
+}
+
+func (a *Authenticator) RequirePermissionFunc(permission string, next http.HandlerFunc) http.HandlerFunc {
+	return a.RequirePermission(permission, next).ServeHTTP
+}
@@ -0,0 +1,294 @@
+package auth_test
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const (
+	secret = "test-secret"
+	kid    = "test"
+)
+
+// signToken builds a token by hand so tests can produce claims Issue never would
+func signToken(t *testing.T, key string, typ string, aud string, subject string, expiry time.Time) string {
+	t.Helper()
+	claims := &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expiry),
+			Issuer:    "chirpy",
+			Audience:  jwt.ClaimStrings{aud},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   subject,
+		},
+		Type: typ,
+	}
+	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+	token.Header["kid"] = kid
+	ts, err := token.SignedString([]byte(key))
+	if err != nil {
+		t.Fatalf("failed to sign token: %s", err.Error())
+	}
+	return ts
+}
+
+func TestBearerToken(t *testing.T) {
+	tests := []struct {
+		name   string
+		header string
+		want   string
+		err    error
+	}{
+		{"missing", "", "", auth.ErrMissingHeader},
+		{"scheme only", "Bearer", "", auth.ErrMalformedHeader},
+		{"scheme with trailing space", "Bearer ", "", auth.ErrMalformedHeader},
+		{"no space", "Bearertoken", "", auth.ErrMalformedHeader},
+		{"wrong scheme", "Basic dXNlcjpwYXNz", "", auth.ErrMalformedHeader},
+		{"too many parts", "Bearer a b", "", auth.ErrMalformedHeader},
+		{"valid", "Bearer abc.def.ghi", "abc.def.ghi", nil},
+		{"lower case scheme", "bearer abc.def.ghi", "abc.def.ghi", nil},
+		{"extra whitespace", "Bearer   abc.def.ghi ", "abc.def.ghi", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			h := http.Header{}
+			if tt.header != "" {
+				h.Set("Authorization", tt.header)
+			}
+			got, err := auth.BearerToken(h)
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("expected error %v, got %v", tt.err, err)
+			}
+			if got != tt.want {
+				t.Fatalf("expected token %q, got %q", tt.want, got)
+			}
+		})
+	}
+}
+
+// tokens without a typ claim or with another type must never pass as access tokens
+func TestRequire(t *testing.T) {
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.DefaultTokenConfig())
+	hour := time.Now().Add(time.Hour)
+	access, err := a.Issue(auth.TokenAccess, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err.Error())
+	}
+	tests := []struct {
+		name   string
+		header string
+		code   int
+	}{
+		{"missing header", "", http.StatusUnauthorized},
+		{"no space", "Bearer" + access, http.StatusUnauthorized},
+		{"not a jwt", "Bearer nonsense", http.StatusUnauthorized},
+		{"wrong scheme", "ApiKey " + access, http.StatusUnauthorized},
+		{"wrong secret", "Bearer " + signToken(t, "other", auth.TokenAccess, "chirpy-api", "1", hour), http.StatusUnauthorized},
+		{"expired", "Bearer " + signToken(t, secret, auth.TokenAccess, "chirpy-api", "1", time.Now().Add(-time.Minute)), http.StatusUnauthorized},
+		{"other type", "Bearer " + signToken(t, secret, "refresh", "chirpy-api", "1", hour), http.StatusUnauthorized},
+		{"no type", "Bearer " + signToken(t, secret, "", "chirpy-api", "1", hour), http.StatusUnauthorized},
+		{"wrong audience", "Bearer " + signToken(t, secret, auth.TokenAccess, "chirpy-refresh", "1", hour), http.StatusUnauthorized},
+		{"bad subject", "Bearer " + signToken(t, secret, auth.TokenAccess, "chirpy-api", "me", hour), http.StatusUnauthorized},
+		{"valid", "Bearer " + access, http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := a.Require(auth.TokenAccess, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				p, ok := auth.PrincipalFrom(r.Context())
+				if !ok || p.UserID != 1 || p.TokenType != auth.TokenAccess {
+					t.Fatalf("expected principal for user 1, got %+v", p)
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				req.Header.Set("Authorization", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, rec.Code)
+			}
+		})
+	}
+}
+
+func TestTokenConfig(t *testing.T) {
+	cfg := auth.DefaultTokenConfig()
+	cfg.Issuer = "chirpy-test"
+	cfg.Audience = "chirpy-test-api"
+	cfg.AccessLifetime = time.Minute * 10
+	cfg.Leeway = time.Minute
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), cfg)
+
+	if got := a.AccessLifetime(time.Hour); got != cfg.AccessLifetime {
+		t.Fatalf("expected requested lifetime to be capped at %v, got %v", cfg.AccessLifetime, got)
+	}
+	if got := a.AccessLifetime(time.Minute); got != time.Minute {
+		t.Fatalf("expected requested lifetime of 1m, got %v", got)
+	}
+	if got := a.AccessLifetime(0); got != cfg.AccessLifetime {
+		t.Fatalf("expected default lifetime %v, got %v", cfg.AccessLifetime, got)
+	}
+
+	ts, err := a.Issue(auth.TokenAccess, 1, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = a.Verify(ts, auth.TokenAccess)
+	if err != nil {
+		t.Fatalf("expected token to verify: %s", err.Error())
+	}
+	// the default issuer and audience no longer match
+	_, err = a.Verify(signToken(t, secret, auth.TokenAccess, "chirpy-api", "1", time.Now().Add(time.Hour)), auth.TokenAccess)
+	if err == nil {
+		t.Fatal("expected token for another issuer and audience to be rejected")
+	}
+	// expired within the leeway still passes
+	expired := signToken(t, secret, auth.TokenAccess, "chirpy-api", "1", time.Now().Add(-time.Second*30))
+	_, err = auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.TokenConfig{
+		Issuer:         "chirpy",
+		Audience:       "chirpy-api",
+		AccessLifetime: time.Hour,
+		Leeway:         time.Minute,
+	}).Verify(expired, auth.TokenAccess)
+	if err != nil {
+		t.Fatalf("expected token expired within the leeway to verify: %s", err.Error())
+	}
+}
+
+func TestVerifyEmailToken(t *testing.T) {
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.DefaultTokenConfig())
+	ts, err := a.IssueVerifyEmail(7, "someone@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := a.Verify(ts, auth.TokenVerifyEmail)
+	if err != nil {
+		t.Fatalf("expected token to verify: %s", err.Error())
+	}
+	if p.UserID != 7 || p.Email != "someone@example.com" {
+		t.Fatalf("unexpected principal %+v", p)
+	}
+	_, err = a.Verify(ts, auth.TokenAccess)
+	if !errors.Is(err, auth.ErrWrongTokenType) {
+		t.Fatalf("expected verification token to be refused as an access token, got %v", err)
+	}
+}
+
+func TestRequireScope(t *testing.T) {
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.DefaultTokenConfig())
+	pat := auth.PersonalTokenPrefix + "bot"
+	a.SetPersonalTokenVerifier(func(token string) (*auth.Principal, error) {
+		if token != pat {
+			return nil, auth.ErrInvalidToken
+		}
+		return &auth.Principal{UserID: 1, TokenType: auth.TokenPersonal, Scopes: []string{auth.ScopeChirpsWrite}}, nil
+	})
+	access, err := a.Issue(auth.TokenAccess, 1, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err.Error())
+	}
+	tests := []struct {
+		name   string
+		token  string
+		scope  string
+		scoped bool
+		code   int
+	}{
+		{"access token has every scope", access, auth.ScopeProfileWrite, true, http.StatusOK},
+		{"personal token with scope", pat, auth.ScopeChirpsWrite, true, http.StatusOK},
+		{"personal token without scope", pat, auth.ScopeProfileWrite, true, http.StatusForbidden},
+		{"unknown personal token", auth.PersonalTokenPrefix + "other", auth.ScopeChirpsWrite, true, http.StatusUnauthorized},
+		{"personal token on unscoped route", pat, "", false, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			})
+			handler := a.Require(auth.TokenAccess, ok)
+			if tt.scoped {
+				handler = a.RequireScope(tt.scope, ok)
+			}
+			req := httptest.NewRequest("GET", "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tt.token)
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, rec.Code)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.DefaultTokenConfig())
+	issue := func(role string) string {
+		ts, err := a.IssueAccess(1, 0, role, time.Hour)
+		if err != nil {
+			t.Fatalf("failed to issue token: %s", err.Error())
+		}
+		return ts
+	}
+	delegated, err := a.IssueDelegated(1, 0, "session", "client", auth.Scopes, time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err.Error())
+	}
+	tests := []struct {
+		name       string
+		token      string
+		permission string
+		code       int
+	}{
+		{"admin", issue(auth.RoleAdmin), auth.PermManageUsers, http.StatusOK},
+		{"moderator may moderate", issue(auth.RoleModerator), auth.PermModerateChirps, http.StatusOK},
+		{"moderator may not manage users", issue(auth.RoleModerator), auth.PermManageUsers, http.StatusForbidden},
+		{"plain user", issue(""), auth.PermModerateChirps, http.StatusForbidden},
+		{"delegated token", delegated, auth.PermModerateChirps, http.StatusForbidden},
+		{"no token", "", auth.PermViewMetrics, http.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			handler := a.RequirePermission(tt.permission, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(http.StatusOK)
+			}))
+			req := httptest.NewRequest("GET", "/", nil)
+			if tt.token != "" {
+				req.Header.Set("Authorization", "Bearer "+tt.token)
+			}
+			rec := httptest.NewRecorder()
+			handler.ServeHTTP(rec, req)
+			if rec.Code != tt.code {
+				t.Fatalf("expected status %d, got %d", tt.code, rec.Code)
+			}
+		})
+	}
+}
+
+// the token version a token was issued with comes back from Verify
+func TestTokenVersion(t *testing.T) {
+	a := auth.NewAuthenticator(auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), nil), auth.DefaultTokenConfig())
+	access, err := a.IssueAccess(1, 3, "", time.Hour)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err.Error())
+	}
+	challenge, err := a.IssueMFAChallenge(1, 4)
+	if err != nil {
+		t.Fatalf("failed to issue token: %s", err.Error())
+	}
+	p, err := a.Verify(access, auth.TokenAccess)
+	if err != nil || p.TokenVersion != 3 {
+		t.Fatalf("expected version 3, got %+v (%v)", p, err)
+	}
+	p, err = a.Verify(challenge, auth.TokenMFA)
+	if err != nil || p.TokenVersion != 4 {
+		t.Fatalf("expected version 4, got %+v (%v)", p, err)
+	}
+}
@@ -0,0 +1,227 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"os"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// KeyRing holds the key that signs new tokens and the retired keys that may
+// still verify tokens signed before the last rotation.
+type KeyRing struct {
+	active  ringKey
+	retired []ringKey
+}
+
+type ringKey struct {
+	key       *Key
+	createdAt time.Time
+	retiredAt time.Time
+}
+
+// NewKeyRing returns a ring with a single active key. now is the clock to
+// use, time.Now when nil.
+func NewKeyRing(key *Key, now func() time.Time) *KeyRing {
+	if now == nil {
+		now = time.Now
+	}
+	return &KeyRing{
+		active: ringKey{key: key, createdAt: now()},
+	}
+}
+
+func (kr *KeyRing) Active() *Key {
+	return kr.active.key
+}
+
+// Lookup finds the key for a kid. Retired keys are only returned until
+// maxLifetime has passed since their retirement, by which time every token
+// they signed has expired.
+func (kr *KeyRing) Lookup(kid string, now time.Time, maxLifetime time.Duration) (*Key, bool) {
+	if kr.active.key.ID == kid {
+		return kr.active.key, true
+	}
+	for _, rk := range kr.retired {
+		if rk.key.ID == kid && now.Before(rk.retiredAt.Add(maxLifetime)) {
+			return rk.key, true
+		}
+	}
+	return nil, false
+}
+
+// Keys lists the active key followed by the retired keys still in the ring.
+func (kr *KeyRing) Keys() []*Key {
+	keys := []*Key{kr.active.key}
+	for _, rk := range kr.retired {
+		keys = append(keys, rk.key)
+	}
+	return keys
+}
+
+// Rotate makes key the active key, retires the previous one and drops keys
+// retired for longer than maxLifetime.
+func (kr *KeyRing) Rotate(key *Key, now time.Time, maxLifetime time.Duration) {
+	old := kr.active
+	old.retiredAt = now
+	kr.active = ringKey{key: key, createdAt: now}
+	kept := []ringKey{old}
+	for _, rk := range kr.retired {
+		if now.Before(rk.retiredAt.Add(maxLifetime)) {
+			kept = append(kept, rk)
+		}
+	}
+	kr.retired = kept
+}
+
+// GenerateKey creates a new random key for the given algorithm.
+func GenerateKey(method jwt.SigningMethod) (*Key, error) {
+	switch method.Alg() {
+	case jwt.SigningMethodHS256.Alg():
+		secret := make([]byte, 32)
+		_, err := rand.Read(secret)
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACKey("", secret), nil
+	case jwt.SigningMethodRS256.Alg():
+		private, err := rsa.GenerateKey(rand.Reader, 2048)
+		if err != nil {
+			return nil, err
+		}
+		return keyFromPrivate(private)
+	case jwt.SigningMethodEdDSA.Alg():
+		_, private, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, err
+		}
+		return keyFromPrivate(private)
+	}
+	return nil, errors.New("unsupported signing algorithm " + method.Alg())
+}
+
+func keyFromPrivate(private interface{}) (*Key, error) {
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKeyPEM("", pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+}
+
+// keyRingFile is the on-disk form of a KeyRing. Secrets are stored as
+// base64 and private keys as PKCS #8 PEM.
+type keyRingFile struct {
+	Keys []keyRingEntry `json:"keys"`
+}
+
+type keyRingEntry struct {
+	ID        string     `json:"kid"`
+	Alg       string     `json:"alg"`
+	Material  string     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	RetiredAt *time.Time `json:"retired_at,omitempty"`
+}
+
+func LoadKeyRing(path string) (*KeyRing, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	f := keyRingFile{}
+	err = json.Unmarshal(data, &f)
+	if err != nil {
+		return nil, err
+	}
+	kr := KeyRing{}
+	for _, entry := range f.Keys {
+		key, err := entry.key()
+		if err != nil {
+			return nil, err
+		}
+		rk := ringKey{key: key, createdAt: entry.CreatedAt}
+		if entry.RetiredAt == nil {
+			if kr.active.key != nil {
+				return nil, errors.New("key ring has more than one active key")
+			}
+			kr.active = rk
+			continue
+		}
+		rk.retiredAt = *entry.RetiredAt
+		kr.retired = append(kr.retired, rk)
+	}
+	if kr.active.key == nil {
+		return nil, errors.New("key ring has no active key")
+	}
+	return &kr, nil
+}
+
+func (kr *KeyRing) Save(path string) error {
+	f := keyRingFile{}
+	for i, rk := range append([]ringKey{kr.active}, kr.retired...) {
+		material, err := rk.key.material()
+		if err != nil {
+			return err
+		}
+		entry := keyRingEntry{
+			ID:        rk.key.ID,
+			Alg:       rk.key.Method.Alg(),
+			Material:  material,
+			CreatedAt: rk.createdAt,
+		}
+		if i > 0 {
+			retiredAt := rk.retiredAt
+			entry.RetiredAt = &retiredAt
+		}
+		f.Keys = append(f.Keys, entry)
+	}
+	data, err := json.MarshalIndent(f, "", "  ")
+	if err != nil {
+		return err
+	}
+	// write then rename so a running server never reads a partial file
+	tmp := path + ".tmp"
+	err = os.WriteFile(tmp, data, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func (k *Key) material() (string, error) {
+	switch private := k.private.(type) {
+	case []byte:
+		return base64.StdEncoding.EncodeToString(private), nil
+	default:
+		der, err := x509.MarshalPKCS8PrivateKey(private)
+		if err != nil {
+			return "", err
+		}
+		return string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})), nil
+	}
+}
+
+func (e keyRingEntry) key() (*Key, error) {
+	if e.Alg == jwt.SigningMethodHS256.Alg() {
+		secret, err := base64.StdEncoding.DecodeString(e.Material)
+		if err != nil {
+			return nil, err
+		}
+		return NewHMACKey(e.ID, secret), nil
+	}
+	key, err := ParsePrivateKeyPEM(e.ID, []byte(e.Material))
+	if err != nil {
+		return nil, err
+	}
+	if key.Method.Alg() != e.Alg {
+		return nil, errors.New("key " + e.ID + " does not match its algorithm " + e.Alg)
+	}
+	return key, nil
+}
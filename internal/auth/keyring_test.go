@@ -0,0 +1,113 @@
+package auth_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+const maxLifetime = time.Hour
+
+// tokens signed before a rotation keep verifying, new tokens use the new key
+func TestKeyRingRotation(t *testing.T) {
+	first, err := auth.GenerateKey(jwt.SigningMethodEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring := auth.NewKeyRing(first, nil)
+	a := auth.NewAuthenticator(ring, auth.DefaultTokenConfig())
+	old, err := a.Issue(auth.TokenAccess, 1, time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	second, err := auth.GenerateKey(jwt.SigningMethodEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Now()
+	ring.Rotate(second, now, maxLifetime)
+	if ring.Active().ID != second.ID {
+		t.Fatalf("expected active key %s, got %s", second.ID, ring.Active().ID)
+	}
+	_, err = a.Verify(old, auth.TokenAccess)
+	if err != nil {
+		t.Fatalf("expected token from retired key to verify: %s", err.Error())
+	}
+	if len(a.JWKS().Keys) != 2 {
+		t.Fatalf("expected both keys in JWKS, got %d", len(a.JWKS().Keys))
+	}
+
+	_, ok := ring.Lookup(first.ID, now.Add(maxLifetime+time.Second), maxLifetime)
+	if ok {
+		t.Fatal("expected retired key to drop out after the longest token lifetime")
+	}
+	third, err := auth.GenerateKey(jwt.SigningMethodEdDSA)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ring.Rotate(third, now.Add(maxLifetime+time.Second), maxLifetime)
+	if len(ring.Keys()) != 2 {
+		t.Fatalf("expected the expired key to be pruned, got %d keys", len(ring.Keys()))
+	}
+}
+
+func TestKeyRingSaveLoad(t *testing.T) {
+	for _, method := range []jwt.SigningMethod{jwt.SigningMethodHS256, jwt.SigningMethodRS256, jwt.SigningMethodEdDSA} {
+		t.Run(method.Alg(), func(t *testing.T) {
+			first, err := auth.GenerateKey(method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			second, err := auth.GenerateKey(method)
+			if err != nil {
+				t.Fatal(err)
+			}
+			ring := auth.NewKeyRing(first, nil)
+			ring.Rotate(second, time.Now(), maxLifetime)
+			path := filepath.Join(t.TempDir(), "keys.json")
+			err = ring.Save(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			loaded, err := auth.LoadKeyRing(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if loaded.Active().ID != second.ID || len(loaded.Keys()) != 2 {
+				t.Fatalf("unexpected ring after load: %v", loaded.Keys())
+			}
+			ts, err := auth.NewAuthenticator(ring, auth.DefaultTokenConfig()).Issue(auth.TokenAccess, 3, time.Hour)
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = auth.NewAuthenticator(loaded, auth.DefaultTokenConfig()).Verify(ts, auth.TokenAccess)
+			if err != nil {
+				t.Fatalf("expected loaded ring to verify: %s", err.Error())
+			}
+		})
+	}
+}
+
+// a new ring records its key's creation on the clock it was given
+func TestNewKeyRingClock(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	ring := auth.NewKeyRing(auth.NewHMACKey(kid, []byte(secret)), func() time.Time { return now })
+	path := filepath.Join(t.TempDir(), "keys.json")
+	err := ring.Save(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(data), `"created_at": "2024-05-01T12:00:00Z"`) {
+		t.Fatalf("expected the key to be created at %v:\n%s", now, data)
+	}
+}
@@ -0,0 +1,137 @@
+package auth
+
+import (
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"os"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+// Key is a signing key pinned to a single algorithm. Tokens are only ever
+// verified with the algorithm of the key their kid header names.
+type Key struct {
+	ID     string
+	Method jwt.SigningMethod
+	// private is []byte, *rsa.PrivateKey or ed25519.PrivateKey; public is
+	// the matching []byte, *rsa.PublicKey or ed25519.PublicKey
+	private interface{}
+	public  interface{}
+}
+
+// NewHMACKey returns an HS256 key for a shared secret.
+func NewHMACKey(id string, secret []byte) *Key {
+	if id == "" {
+		id = keyID(secret)
+	}
+	return &Key{
+		ID:      id,
+		Method:  jwt.SigningMethodHS256,
+		private: secret,
+		public:  secret,
+	}
+}
+
+// ParsePrivateKeyPEM reads an RSA (RS256) or Ed25519 (EdDSA) private key. When
+// id is empty the key ID is derived from the public key.
+func ParsePrivateKeyPEM(id string, data []byte) (*Key, error) {
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, errors.New("no PEM block found")
+	}
+	var parsed interface{}
+	var err error
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		parsed, err = x509.ParsePKCS1PrivateKey(block.Bytes)
+	case "PRIVATE KEY":
+		parsed, err = x509.ParsePKCS8PrivateKey(block.Bytes)
+	default:
+		return nil, errors.New("unsupported PEM block " + block.Type)
+	}
+	if err != nil {
+		return nil, err
+	}
+	key := Key{ID: id, private: parsed}
+	switch k := parsed.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 2048 {
+			return nil, errors.New("RSA keys must be at least 2048 bits")
+		}
+		key.Method = jwt.SigningMethodRS256
+		key.public = &k.PublicKey
+	case ed25519.PrivateKey:
+		key.Method = jwt.SigningMethodEdDSA
+		key.public = k.Public()
+	default:
+		return nil, errors.New("unsupported private key type")
+	}
+	if key.ID == "" {
+		der, err := x509.MarshalPKIXPublicKey(key.public)
+		if err != nil {
+			return nil, err
+		}
+		key.ID = keyID(der)
+	}
+	return &key, nil
+}
+
+func LoadPrivateKeyFile(id string, path string) (*Key, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	return ParsePrivateKeyPEM(id, data)
+}
+
+// keyID derives a stable identifier from key material.
+func keyID(material []byte) string {
+	sum := sha256.Sum256(material)
+	return hex.EncodeToString(sum[:8])
+}
+
+// JWK is the public half of a key in RFC 7517 form.
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Alg string `json:"alg"`
+	Use string `json:"use"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+type JWKS struct {
+	Keys []JWK `json:"keys"`
+}
+
+// JWK returns the public form of the key. Shared secrets have none.
+func (k *Key) JWK() (JWK, bool) {
+	jwk := JWK{
+		Kid: k.ID,
+		Alg: k.Method.Alg(),
+		Use: "sig",
+	}
+	enc := base64.RawURLEncoding
+	switch pub := k.public.(type) {
+	case *rsa.PublicKey:
+		jwk.Kty = "RSA"
+		jwk.N = enc.EncodeToString(pub.N.Bytes())
+		jwk.E = enc.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+	case ed25519.PublicKey:
+		jwk.Kty = "OKP"
+		jwk.Crv = "Ed25519"
+		jwk.X = enc.EncodeToString(pub)
+	default:
+		return JWK{}, false
+	}
+	return jwk, true
+}
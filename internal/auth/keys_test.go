@@ -0,0 +1,125 @@
+package auth_test
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func pemKey(t *testing.T, key interface{}) []byte {
+	t.Helper()
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatalf("failed to marshal key: %s", err.Error())
+	}
+	return pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})
+}
+
+// asymmetric keys sign and verify their own tokens and publish a JWK
+func TestAsymmetricKeys(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		pem  []byte
+		alg  string
+		kty  string
+	}{
+		{"rsa", pemKey(t, rsaKey), "RS256", "RSA"},
+		{"ed25519", pemKey(t, edKey), "EdDSA", "OKP"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			key, err := auth.ParsePrivateKeyPEM("", tt.pem)
+			if err != nil {
+				t.Fatalf("failed to parse key: %s", err.Error())
+			}
+			if key.Method.Alg() != tt.alg || key.ID == "" {
+				t.Fatalf("expected %s key with an ID, got %s %q", tt.alg, key.Method.Alg(), key.ID)
+			}
+			a := auth.NewAuthenticator(auth.NewKeyRing(key, nil), auth.DefaultTokenConfig())
+			ts, err := a.Issue(auth.TokenAccess, 7, time.Hour)
+			if err != nil {
+				t.Fatalf("failed to issue token: %s", err.Error())
+			}
+			p, err := a.Verify(ts, auth.TokenAccess)
+			if err != nil || p.UserID != 7 {
+				t.Fatalf("expected token for user 7, got %v, %v", p, err)
+			}
+			jwks := a.JWKS()
+			if len(jwks.Keys) != 1 || jwks.Keys[0].Kty != tt.kty || jwks.Keys[0].Kid != key.ID {
+				t.Fatalf("unexpected JWKS %+v", jwks)
+			}
+		})
+	}
+}
+
+// a token may not choose a different algorithm from the key it names
+func TestAlgorithmPinned(t *testing.T) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	key, err := auth.ParsePrivateKeyPEM("rsa", pemKey(t, rsaKey))
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := auth.NewAuthenticator(auth.NewKeyRing(key, nil), auth.DefaultTokenConfig())
+	pub, err := x509.MarshalPKIXPublicKey(&rsaKey.PublicKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	claims := &auth.Claims{
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(time.Hour)),
+			Issuer:    "chirpy",
+			Audience:  jwt.ClaimStrings{"chirpy-api"},
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Subject:   "1",
+		},
+		Type: auth.TokenAccess,
+	}
+	forged := map[string]func() (string, error){
+		// HS256 keyed with the public key, the classic confusion attack
+		"hs256 with public key": func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+			token.Header["kid"] = "rsa"
+			return token.SignedString(pem.EncodeToMemory(&pem.Block{Type: "PUBLIC KEY", Bytes: pub}))
+		},
+		"none": func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodNone, claims)
+			token.Header["kid"] = "rsa"
+			return token.SignedString(jwt.UnsafeAllowNoneSignatureType)
+		},
+		"unknown kid": func() (string, error) {
+			token := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+			token.Header["kid"] = "other"
+			return token.SignedString(rsaKey)
+		},
+	}
+	for name, forge := range forged {
+		t.Run(name, func(t *testing.T) {
+			ts, err := forge()
+			if err != nil {
+				t.Fatalf("failed to sign token: %s", err.Error())
+			}
+			_, err = a.Verify(ts, auth.TokenAccess)
+			if err == nil {
+				t.Fatal("expected forged token to be rejected")
+			}
+		})
+	}
+}
@@ -0,0 +1,351 @@
+package config
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/password"
+	"github.com/joho/godotenv"
+	"golang.org/x/crypto/bcrypt"
+	"gopkg.in/yaml.v3"
+)
+
+const (
+	// MinSecretLength is the shortest JWT_SECRET accepted, 256 bits for HS256
+	MinSecretLength = 32
+	// MinKeyLength is the shortest API key or token accepted
+	MinKeyLength = 16
+
+	// redacted replaces the value of secrets when the configuration is printed
+	redacted = "[redacted]"
+)
+
+// Config is the server configuration. Every setting has a command line flag
+// such as -jwt-secret, an environment variable such as JWT_SECRET and a YAML
+// key such as jwt_secret.
+type Config struct {
+	Port         int
+	PublicURL    string
+	DatabasePath string
+	ExportDir    string
+
+	JWTSecret         string
+	JWTKeyID          string
+	JWTSigningKeyFile string
+	JWTKeyRingFile    string
+	JWTIssuer         string
+	JWTAudience       string
+	JWTLeeway         time.Duration
+	AccessTokenTTL    time.Duration
+	RefreshTokenTTL   time.Duration
+	VerifyEmailTTL    time.Duration
+	MFAChallengeTTL   time.Duration
+
+	PolkaAPIKey  string
+	AdminAPIKey  string
+	MetricsToken string
+
+	PasswordHash          string
+	BcryptCost            int
+	Argon2MemoryKiB       int
+	Argon2Iterations      int
+	Argon2Parallelism     int
+	PasswordMinLength     int
+	PasswordBlocklistFile string
+	PasswordResetTTL      time.Duration
+
+	MailFrom     string
+	MailDir      string
+	SMTPAddr     string
+	SMTPUsername string
+	SMTPPassword string
+
+	AccountDeletionGrace time.Duration
+	DeletedChirpsPolicy  string
+}
+
+// secrets are the settings redacted by Print.
+var secrets = map[string]bool{
+	"jwt-secret":    true,
+	"polka-api-key": true,
+	"admin-api-key": true,
+	"metrics-token": true,
+	"smtp-password": true,
+}
+
+// Default returns the configuration used for settings left unset. It has no
+// secrets, so it does not validate on its own.
+func Default() *Config {
+	tokens := auth.DefaultTokenConfig()
+	passwords := password.DefaultPolicy()
+	return &Config{
+		Port:                 8080,
+		DatabasePath:         database.DefaultPath,
+		ExportDir:            "./exports",
+		JWTIssuer:            tokens.Issuer,
+		JWTAudience:          tokens.Audience,
+		JWTLeeway:            tokens.Leeway,
+		AccessTokenTTL:       tokens.AccessLifetime,
+		RefreshTokenTTL:      time.Hour * 24 * 60,
+		VerifyEmailTTL:       tokens.VerifyEmailLifetime,
+		MFAChallengeTTL:      tokens.MFALifetime,
+		PasswordHash:         passwords.Algorithm,
+		BcryptCost:           passwords.BcryptCost,
+		Argon2MemoryKiB:      int(passwords.Argon2.Memory),
+		Argon2Iterations:     int(passwords.Argon2.Iterations),
+		Argon2Parallelism:    int(passwords.Argon2.Parallelism),
+		PasswordMinLength:    passwords.MinLength,
+		PasswordResetTTL:     time.Hour,
+		MailFrom:             "chirpy@localhost",
+		AccountDeletionGrace: time.Hour * 24 * 30,
+		DeletedChirpsPolicy:  string(database.ChirpPolicyDelete),
+	}
+}
+
+// flagSet registers every setting of c as a flag.
+func (c *Config) flagSet() *flag.FlagSet {
+	f := flag.NewFlagSet("chirpy", flag.ContinueOnError)
+	f.IntVar(&c.Port, "port", c.Port, "port to listen on")
+	f.StringVar(&c.PublicURL, "public-url", c.PublicURL, "URL the server is reached at, used in emailed links (default http://localhost:<port>)")
+	f.StringVar(&c.DatabasePath, "database-path", c.DatabasePath, "path of the JSON database")
+	f.StringVar(&c.ExportDir, "export-dir", c.ExportDir, "directory data export archives are written to")
+
+	f.StringVar(&c.JWTSecret, "jwt-secret", c.JWTSecret, "HMAC secret tokens are signed with")
+	f.StringVar(&c.JWTKeyID, "jwt-key-id", c.JWTKeyID, "kid of the signing key")
+	f.StringVar(&c.JWTSigningKeyFile, "jwt-signing-key-file", c.JWTSigningKeyFile, "PEM private key to sign tokens with instead of the secret")
+	f.StringVar(&c.JWTKeyRingFile, "jwt-keyring-file", c.JWTKeyRingFile, "key ring file, enabling key rotation")
+	f.StringVar(&c.JWTIssuer, "jwt-issuer", c.JWTIssuer, "iss claim of issued tokens")
+	f.StringVar(&c.JWTAudience, "jwt-audience", c.JWTAudience, "aud claim of issued tokens")
+	f.DurationVar(&c.JWTLeeway, "jwt-leeway", c.JWTLeeway, "clock skew allowed when checking token times")
+	f.DurationVar(&c.AccessTokenTTL, "access-token-ttl", c.AccessTokenTTL, "lifetime of access tokens")
+	f.DurationVar(&c.RefreshTokenTTL, "refresh-token-ttl", c.RefreshTokenTTL, "lifetime of refresh tokens")
+	f.DurationVar(&c.VerifyEmailTTL, "verify-email-ttl", c.VerifyEmailTTL, "lifetime of email verification links")
+	f.DurationVar(&c.MFAChallengeTTL, "mfa-challenge-ttl", c.MFAChallengeTTL, "time allowed to enter a two-factor code")
+
+	f.StringVar(&c.PolkaAPIKey, "polka-api-key", c.PolkaAPIKey, "API key Polka webhooks are sent with")
+	f.StringVar(&c.AdminAPIKey, "admin-api-key", c.AdminAPIKey, "API key for admin endpoints, disabled when empty")
+	f.StringVar(&c.MetricsToken, "metrics-token", c.MetricsToken, "bearer token required to scrape /metrics")
+
+	f.StringVar(&c.PasswordHash, "password-hash", c.PasswordHash, "password hashing algorithm, bcrypt or argon2id")
+	f.IntVar(&c.BcryptCost, "bcrypt-cost", c.BcryptCost, "bcrypt cost")
+	f.IntVar(&c.Argon2MemoryKiB, "argon2-memory-kib", c.Argon2MemoryKiB, "argon2id memory in KiB")
+	f.IntVar(&c.Argon2Iterations, "argon2-iterations", c.Argon2Iterations, "argon2id iterations")
+	f.IntVar(&c.Argon2Parallelism, "argon2-parallelism", c.Argon2Parallelism, "argon2id parallelism")
+	f.IntVar(&c.PasswordMinLength, "password-min-length", c.PasswordMinLength, "shortest password accepted")
+	f.StringVar(&c.PasswordBlocklistFile, "password-blocklist-file", c.PasswordBlocklistFile, "file of further passwords to reject, one per line")
+	f.DurationVar(&c.PasswordResetTTL, "password-reset-ttl", c.PasswordResetTTL, "lifetime of password reset links")
+
+	f.StringVar(&c.MailFrom, "mail-from", c.MailFrom, "sender of emails")
+	f.StringVar(&c.MailDir, "mail-dir", c.MailDir, "directory emails are written to when SMTP is not configured")
+	f.StringVar(&c.SMTPAddr, "smtp-addr", c.SMTPAddr, "SMTP server, host:port")
+	f.StringVar(&c.SMTPUsername, "smtp-username", c.SMTPUsername, "SMTP username")
+	f.StringVar(&c.SMTPPassword, "smtp-password", c.SMTPPassword, "SMTP password")
+
+	f.DurationVar(&c.AccountDeletionGrace, "account-deletion-grace", c.AccountDeletionGrace, "time before a deleted account is purged")
+	f.StringVar(&c.DeletedChirpsPolicy, "deleted-chirps-policy", c.DeletedChirpsPolicy, "what happens to the chirps of purged accounts, delete or anonymise")
+	return f
+}
+
+// envName is the environment variable of a flag, e.g. JWT_SECRET for
+// jwt-secret.
+func envName(flagName string) string {
+	return strings.ToUpper(strings.ReplaceAll(flagName, "-", "_"))
+}
+
+// Load reads the configuration from, in increasing order of precedence, the
+// defaults, a YAML file, a .env file, the environment and the command line
+// flags in args. The YAML file is named by -config or CHIRPY_CONFIG; the
+// .env file by -env-file, and is optional unless given explicitly.
+// lookupEnv is os.LookupEnv outside of tests; empty variables count as unset.
+//
+// Load returns the arguments left after the flags, i.e. a command. The
+// configuration is not validated, see Validate.
+func Load(args []string, lookupEnv func(string) (string, bool)) (*Config, []string, error) {
+	c := Default()
+	flags := c.flagSet()
+	configFile := ""
+	envFile := ".env"
+	flags.StringVar(&configFile, "config", "", "YAML configuration file (env CHIRPY_CONFIG)")
+	flags.StringVar(&envFile, "env-file", envFile, "file of environment variables to load")
+	err := flags.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+	explicit := map[string]bool{}
+	flags.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	dotenv := map[string]string{}
+	if envFile != "" {
+		dotenv, err = godotenv.Read(envFile)
+		if errors.Is(err, fs.ErrNotExist) && !explicit["env-file"] {
+			dotenv, err = map[string]string{}, nil
+		}
+		if err != nil {
+			return nil, nil, fmt.Errorf("failed to read %s: %w", envFile, err)
+		}
+	}
+	lookup := func(name string) string {
+		if v, ok := lookupEnv(name); ok && v != "" {
+			return v
+		}
+		return dotenv[name]
+	}
+
+	if configFile == "" {
+		configFile = lookup("CHIRPY_CONFIG")
+	}
+	file := map[string]string{}
+	if configFile != "" {
+		file, err = readYAML(configFile, flags)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+
+	flags.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] || f.Name == "config" || f.Name == "env-file" {
+			return
+		}
+		source, v := envName(f.Name), lookup(envName(f.Name))
+		if v == "" {
+			source, v = configFile, file[f.Name]
+		}
+		if v == "" {
+			return
+		}
+		if f.Value.Set(v) != nil {
+			err = fmt.Errorf("invalid %s in %s: %q", envName(f.Name), source, v)
+		}
+	})
+	if err != nil {
+		return nil, nil, err
+	}
+	c.PublicURL = strings.TrimSuffix(c.PublicURL, "/")
+	if c.PublicURL == "" {
+		c.PublicURL = fmt.Sprintf("http://localhost:%d", c.Port)
+	}
+	return c, flags.Args(), nil
+}
+
+// readYAML reads a flat YAML file of settings, keyed like jwt_secret, into
+// values by flag name.
+func readYAML(path string, flags *flag.FlagSet) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", path, err)
+	}
+	doc := map[string]any{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+	values := map[string]string{}
+	for key, v := range doc {
+		name := strings.ReplaceAll(key, "_", "-")
+		if flags.Lookup(name) == nil || name == "config" || name == "env-file" {
+			return nil, fmt.Errorf("unknown setting %q in %s", key, path)
+		}
+		switch v := v.(type) {
+		case nil:
+		case string, int, float64, bool:
+			values[name] = fmt.Sprint(v)
+		default:
+			return nil, fmt.Errorf("setting %q in %s must be a single value", key, path)
+		}
+	}
+	return values, nil
+}
+
+// Validate checks the settings, reporting every problem at once.
+func (c *Config) Validate() error {
+	errs := []error{}
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	check(c.Port > 0 && c.Port <= 65535, "PORT must be between 1 and 65535")
+	u, err := url.Parse(c.PublicURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "PUBLIC_URL must be an http or https URL")
+	check(c.DatabasePath != "", "DATABASE_PATH is required")
+	check(c.ExportDir != "", "EXPORT_DIR is required")
+
+	// the secret is only used to sign tokens without a signing key file
+	if c.JWTSigningKeyFile == "" {
+		check(c.JWTSecret != "", "JWT_SECRET is required")
+		check(c.JWTSecret == "" || len(c.JWTSecret) >= MinSecretLength, "JWT_SECRET must be at least %d bytes", MinSecretLength)
+	}
+	check(c.JWTLeeway >= 0, "JWT_LEEWAY must not be negative")
+	for _, d := range []struct {
+		name  string
+		value time.Duration
+	}{
+		{"ACCESS_TOKEN_TTL", c.AccessTokenTTL},
+		{"REFRESH_TOKEN_TTL", c.RefreshTokenTTL},
+		{"VERIFY_EMAIL_TTL", c.VerifyEmailTTL},
+		{"MFA_CHALLENGE_TTL", c.MFAChallengeTTL},
+		{"PASSWORD_RESET_TTL", c.PasswordResetTTL},
+		{"ACCOUNT_DELETION_GRACE", c.AccountDeletionGrace},
+	} {
+		check(d.value > 0, "%s must be positive", d.name)
+	}
+
+	check(c.PolkaAPIKey != "", "POLKA_API_KEY is required")
+	for _, key := range []struct {
+		name  string
+		value string
+	}{
+		{"POLKA_API_KEY", c.PolkaAPIKey},
+		{"ADMIN_API_KEY", c.AdminAPIKey},
+		{"METRICS_TOKEN", c.MetricsToken},
+	} {
+		check(key.value == "" || len(key.value) >= MinKeyLength, "%s must be at least %d characters", key.name, MinKeyLength)
+	}
+
+	check(c.PasswordHash == password.Bcrypt || c.PasswordHash == password.Argon2id, "PASSWORD_HASH must be %s or %s", password.Bcrypt, password.Argon2id)
+	check(c.BcryptCost >= bcrypt.MinCost && c.BcryptCost <= bcrypt.MaxCost, "BCRYPT_COST must be between %d and %d", bcrypt.MinCost, bcrypt.MaxCost)
+	check(c.Argon2MemoryKiB > 0, "ARGON2_MEMORY_KIB must be positive")
+	check(c.Argon2Iterations > 0, "ARGON2_ITERATIONS must be positive")
+	check(c.Argon2Parallelism > 0 && c.Argon2Parallelism <= 255, "ARGON2_PARALLELISM must be between 1 and 255")
+	check(c.PasswordMinLength > 0, "PASSWORD_MIN_LENGTH must be positive")
+
+	check(c.MailFrom != "", "MAIL_FROM is required")
+	check(c.SMTPAddr == "" || strings.Contains(c.SMTPAddr, ":"), "SMTP_ADDR must be host:port")
+
+	policy := database.ChirpPolicy(c.DeletedChirpsPolicy)
+	check(policy == database.ChirpPolicyDelete || policy == database.ChirpPolicyAnonymise,
+		"DELETED_CHIRPS_POLICY must be %s or %s", database.ChirpPolicyDelete, database.ChirpPolicyAnonymise)
+	return errors.Join(errs...)
+}
+
+// Addr is the address to listen on.
+func (c *Config) Addr() string {
+	return fmt.Sprintf(":%d", c.Port)
+}
+
+// Print writes the configuration as environment variables, with secrets
+// redacted.
+func (c *Config) Print(w io.Writer) error {
+	var err error
+	c.flagSet().VisitAll(func(f *flag.Flag) {
+		v := f.Value.String()
+		if secrets[f.Name] && v != "" {
+			v = redacted
+		}
+		if err == nil {
+			_, err = fmt.Fprintf(w, "%s=%s\n", envName(f.Name), v)
+		}
+	})
+	return err
+}
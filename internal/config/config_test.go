@@ -0,0 +1,160 @@
+package config_test
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/config"
+)
+
+const secret = "a test secret of thirty two bytes"
+
+// env returns a lookupEnv reading from vars.
+func env(vars map[string]string) func(string) (string, bool) {
+	return func(name string) (string, bool) {
+		v, ok := vars[name]
+		return v, ok
+	}
+}
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	err := os.WriteFile(path, []byte(content), 0600)
+	if err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+// flags override the environment, which overrides .env, which overrides YAML
+func TestLoadPrecedence(t *testing.T) {
+	yamlFile := writeFile(t, "chirpy.yaml", "port: 9000\naccess_token_ttl: 10m\njwt_issuer: yaml\nmail_from: yaml@example.com\n")
+	envFile := writeFile(t, ".env", "ACCESS_TOKEN_TTL=20m\nJWT_ISSUER=dotenv\n")
+	vars := map[string]string{
+		"CHIRPY_CONFIG": yamlFile,
+		"JWT_ISSUER":    "env",
+		"MAIL_FROM":     "",
+	}
+	c, args, err := config.Load([]string{"-env-file", envFile, "-port", "9100", "keys", "rotate"}, env(vars))
+	if err != nil {
+		t.Fatalf("failed to load: %v", err)
+	}
+	if c.Port != 9100 || c.AccessTokenTTL != time.Minute*20 || c.JWTIssuer != "env" || c.MailFrom != "yaml@example.com" {
+		t.Fatalf("unexpected configuration: %+v", c)
+	}
+	if c.PublicURL != "http://localhost:9100" {
+		t.Fatalf("expected the public URL to default to the port, got %q", c.PublicURL)
+	}
+	if strings.Join(args, " ") != "keys rotate" {
+		t.Fatalf("expected the command to be returned, got %v", args)
+	}
+}
+
+func TestLoadErrors(t *testing.T) {
+	cases := map[string]struct {
+		args []string
+		yaml string
+		vars map[string]string
+	}{
+		"bad duration in env":   {vars: map[string]string{"ACCESS_TOKEN_TTL": "soon"}},
+		"unknown flag":          {args: []string{"-no-such-flag"}},
+		"missing explicit .env": {args: []string{"-env-file", "/nonexistent/.env"}},
+		"unknown YAML setting":  {yaml: "jwt_secrt: oops\n"},
+		"nested YAML setting":   {yaml: "port:\n  http: 80\n"},
+		"bad integer in YAML":   {yaml: "bcrypt_cost: high\n"},
+		"missing CHIRPY_CONFIG": {vars: map[string]string{"CHIRPY_CONFIG": "/nonexistent/chirpy.yaml"}},
+		"config flag in YAML":   {yaml: "config: other.yaml\n"},
+		"env-file flag in YAML": {yaml: "env_file: other.env\n"},
+	}
+	for name, tc := range cases {
+		t.Run(name, func(t *testing.T) {
+			args := tc.args
+			if tc.yaml != "" {
+				args = append(args, "-config", writeFile(t, "chirpy.yaml", tc.yaml))
+			}
+			_, _, err := config.Load(args, env(tc.vars))
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+		})
+	}
+}
+
+func TestValidate(t *testing.T) {
+	valid := func() *config.Config {
+		c := config.Default()
+		c.PublicURL = "https://chirpy.example.com"
+		c.JWTSecret = secret
+		c.PolkaAPIKey = "a test polka api key"
+		return c
+	}
+	err := valid().Validate()
+	if err != nil {
+		t.Fatalf("expected a valid configuration, got %v", err)
+	}
+
+	cases := map[string]func(c *config.Config){
+		"empty secret":        func(c *config.Config) { c.JWTSecret = "" },
+		"short secret":        func(c *config.Config) { c.JWTSecret = "short" },
+		"empty polka key":     func(c *config.Config) { c.PolkaAPIKey = "" },
+		"short admin key":     func(c *config.Config) { c.AdminAPIKey = "admin" },
+		"bad port":            func(c *config.Config) { c.Port = 70000 },
+		"bad public URL":      func(c *config.Config) { c.PublicURL = "chirpy.example.com" },
+		"negative TTL":        func(c *config.Config) { c.RefreshTokenTTL = -time.Hour },
+		"bad hash algorithm":  func(c *config.Config) { c.PasswordHash = "md5" },
+		"bcrypt cost too low": func(c *config.Config) { c.BcryptCost = 1 },
+		"bad chirp policy":    func(c *config.Config) { c.DeletedChirpsPolicy = "keep" },
+	}
+	for name, change := range cases {
+		t.Run(name, func(t *testing.T) {
+			c := valid()
+			change(c)
+			if c.Validate() == nil {
+				t.Fatal("expected the configuration to be rejected")
+			}
+		})
+	}
+
+	// a signing key file replaces the secret
+	c := valid()
+	c.JWTSecret = ""
+	c.JWTSigningKeyFile = "signing.pem"
+	err = c.Validate()
+	if err != nil {
+		t.Fatalf("expected a signing key file to stand in for the secret, got %v", err)
+	}
+
+	// every problem is reported together
+	c = config.Default()
+	err = c.Validate()
+	if err == nil || !strings.Contains(err.Error(), "JWT_SECRET") || !strings.Contains(err.Error(), "POLKA_API_KEY") {
+		t.Fatalf("expected both missing secrets to be reported, got %v", err)
+	}
+}
+
+func TestPrintRedactsSecrets(t *testing.T) {
+	c := config.Default()
+	c.JWTSecret = secret
+	c.SMTPAddr = "smtp.example.com:587"
+	buf := &bytes.Buffer{}
+	err := c.Print(buf)
+	if err != nil {
+		t.Fatalf("failed to print: %v", err)
+	}
+	out := buf.String()
+	if strings.Contains(out, secret) || !strings.Contains(out, "JWT_SECRET=[redacted]\n") {
+		t.Fatalf("expected JWT_SECRET to be redacted:\n%s", out)
+	}
+	// unset secrets are shown as unset rather than redacted
+	if !strings.Contains(out, "POLKA_API_KEY=\n") {
+		t.Fatalf("expected POLKA_API_KEY to be empty:\n%s", out)
+	}
+	if !strings.Contains(out, "SMTP_ADDR=smtp.example.com:587\n") || !strings.Contains(out, "PORT=8080\n") {
+		t.Fatalf("expected settings to be printed:\n%s", out)
+	}
+}
@@ -1,20 +1,27 @@
 package database
 
 import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
 	"os"
-	"strconv"
+	"path/filepath"
+	"sort"
 	"sync"
 	"time"
 
-	"github.com/golang-jwt/jwt/v5"
-	"golang.org/x/crypto/bcrypt"
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/am1macdonald/chirpy/internal/password"
 )
 
-const (
-	dbPath = "./database.json"
-)
+// DefaultPath is where the server keeps its database.
+const DefaultPath = "./database.json"
 
 type Chirp struct {
 	ID       int    `json:"id"`
@@ -23,83 +30,340 @@ type Chirp struct {
 }
 
 type User struct {
-	ID          int    `json:"id"`
-	Email       string `json:"email"`
-	Password    string `json:"password"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+	ID          int          `json:"id"`
+	Email       string       `json:"email"`
+	Password    string       `json:"password"`
+	IsChirpyRed bool         `json:"is_chirpy_red"`
+	Settings    UserSettings `json:"settings"`
+	// access tokens issued before this time are no longer accepted
+	TokensRevokedAt time.Time `json:"tokens_revoked_at"`
+	// TokenVersion is carried by the tokens issued to the user; revoking
+	// them moves it on
+	TokenVersion int `json:"token_version,omitempty"`
+	// set while the account waits out its deletion grace period
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+	// set from signup or an email change until the address is confirmed;
+	// accounts created before verification existed count as verified
+	EmailUnverified bool `json:"email_unverified,omitempty"`
+	// two-factor authentication, nil until the user starts enrolling
+	TOTP *TOTP `json:"totp,omitempty"`
+	// Role is one of the auth roles, empty for plain users
+	Role string `json:"role,omitempty"`
+	// CreatedAt is zero for accounts created before it was recorded
+	CreatedAt time.Time `json:"created_at"`
 }
 
-func (u *User) Validate(password string) bool {
-	err := bcrypt.CompareHashAndPassword([]byte(u.Password), []byte(password))
-	return err == nil
+// TOTP is a user's time-based one-time password setup.
+type TOTP struct {
+	Secret string `json:"secret"`
+	// Enabled once the first code has confirmed enrolment
+	Enabled bool `json:"enabled"`
+	// LastCounter is the time step of the last accepted code, so a code
+	// cannot be used twice
+	LastCounter int64 `json:"last_counter"`
+	// RecoveryCodes are the SHA-256 hashes of the unused recovery codes
+	RecoveryCodes []string `json:"recovery_codes"`
 }
 
-func (u *User) GetAccessToken(secret string) (string, error) {
-	expiry := time.Now().Add(time.Duration(time.Hour * 1))
-	claims := &jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(expiry),
-		Issuer:    "chirpy-access",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Subject:   strconv.Itoa(u.ID),
-	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+type UserSettings struct {
+	// DefaultChirpSort orders chirps listed for the user when the request
+	// does not ask for an order, "asc" or "desc"
+	DefaultChirpSort string `json:"default_chirp_sort"`
 }
 
-func (u *User) GetRefreshToken(secret string) (string, error) {
-	expiry := time.Now().Add(time.Duration(time.Hour * 24 * 60))
-	claims := &jwt.RegisteredClaims{
-		ExpiresAt: jwt.NewNumericDate(expiry),
-		Issuer:    "chirpy-refresh",
-		IssuedAt:  jwt.NewNumericDate(time.Now()),
-		Subject:   strconv.Itoa(u.ID),
-	}
-	return jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte(secret))
+func (u *User) Validate(plaintext string) bool {
+	return password.Verify(u.Password, plaintext)
+}
+
+func (u *User) GetAccessToken(a *auth.Authenticator, ttl time.Duration) (string, error) {
+	return a.IssueAccess(u.ID, u.TokenVersion, u.Role, ttl)
 }
 
-func (u *User) UpdatePassword(password string) error {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 4)
+// GetDelegatedAccessToken issues an access token for an OAuth client acting
+// for the user within the granted scopes, tied to the session it was
+// issued from.
+func (u *User) GetDelegatedAccessToken(a *auth.Authenticator, session string, grant Grant, ttl time.Duration) (string, error) {
+	return a.IssueDelegated(u.ID, u.TokenVersion, session, grant.ClientID, grant.Scopes, ttl)
+}
+
+func (u *User) UpdatePassword(p *password.Policy, plaintext string) error {
+	hash, err := p.Hash(plaintext)
 	if err != nil {
 		return err
 	}
-	u.Password = string(hash)
+	u.Password = hash
 	return nil
 }
 
+// RevokeTokens invalidates every access token issued to the user so far.
+// Refresh tokens are revoked with DB.RevokeUserRefreshTokens.
+func (u *User) RevokeTokens(now time.Time) {
+	u.TokensRevokedAt = now
+	u.TokenVersion++
+}
+
+// TokenRevoked reports whether a token issued at issuedAt with the given
+// token version has been revoked. JWT timestamps only carry whole seconds,
+// too coarse to tell apart tokens issued in the second of a revocation, so
+// the version decides; the time only matters for tokens issued before
+// versions existed.
+func (u *User) TokenRevoked(issuedAt time.Time, version int) bool {
+	return version < u.TokenVersion || issuedAt.Unix() < u.TokensRevokedAt.Unix()
+}
+
+// Deleted reports whether the account is pending deletion.
+func (u *User) Deleted() bool {
+	return u.DeletedAt != nil
+}
+
+func (u *User) Verified() bool {
+	return !u.EmailUnverified
+}
+
+func (u *User) TwoFactorEnabled() bool {
+	return u.TOTP != nil && u.TOTP.Enabled
+}
+
+// SetRecoveryCodes replaces the user's recovery codes, keeping only hashes.
+func (u *User) SetRecoveryCodes(codes []string) {
+	u.TOTP.RecoveryCodes = []string{}
+	for _, code := range codes {
+		u.TOTP.RecoveryCodes = append(u.TOTP.RecoveryCodes, hashToken(code))
+	}
+}
+
+// UseRecoveryCode reports whether code is one of the user's unused recovery
+// codes, and uses it up. Call it within DB.UpdateUser.
+func (u *User) UseRecoveryCode(code string) bool {
+	if u.TOTP == nil {
+		return false
+	}
+	hash := hashToken(code)
+	for i, h := range u.TOTP.RecoveryCodes {
+		if subtle.ConstantTimeCompare([]byte(h), []byte(hash)) == 1 {
+			u.TOTP.RecoveryCodes = append(u.TOTP.RecoveryCodes[:i], u.TOTP.RecoveryCodes[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// ChirpPolicy decides what happens to a deleted user's chirps when the account is purged.
+type ChirpPolicy string
+
+const (
+	ChirpPolicyDelete    ChirpPolicy = "delete"
+	ChirpPolicyAnonymise ChirpPolicy = "anonymise"
+)
+
+type ExportStatus string
+
+const (
+	ExportPending ExportStatus = "pending"
+	ExportReady   ExportStatus = "ready"
+	ExportFailed  ExportStatus = "failed"
+)
+
+// Export is a personal data export job and, once ready, the archive it produced.
+type Export struct {
+	ID          string       `json:"id"`
+	UserID      int          `json:"user_id"`
+	Status      ExportStatus `json:"status"`
+	Path        string       `json:"path"`
+	CreatedAt   time.Time    `json:"created_at"`
+	CompletedAt *time.Time   `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time   `json:"expires_at,omitempty"`
+}
+
+// UserData is everything held about a single user, read from one snapshot.
+type UserData struct {
+	User   User
+	Chirps []Chirp
+}
+
+// RefreshToken is an opaque refresh token, stored by the SHA-256 hash of its
+// value. Every refresh replaces the token with a new one in the same family;
+// presenting a replaced token again revokes the whole family.
+type RefreshToken struct {
+	Hash     string `json:"hash"`
+	UserID   int    `json:"user_id"`
+	FamilyID string `json:"family_id"`
+	Client
+	Grant
+	// when the family was started by logging in
+	SessionCreatedAt time.Time  `json:"session_created_at"`
+	CreatedAt        time.Time  `json:"created_at"`
+	ExpiresAt        time.Time  `json:"expires_at"`
+	UsedAt           *time.Time `json:"used_at,omitempty"`
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+}
+
+// Client describes where a refresh token is being used from.
+type Client struct {
+	Device    string `json:"device"`
+	IP        string `json:"ip"`
+	UserAgent string `json:"user_agent"`
+}
+
+// Grant limits a refresh token family to an OAuth client and the scopes the
+// user consented to. First-party logins have an empty grant.
+type Grant struct {
+	ClientID string   `json:"client_id,omitempty"`
+	Scopes   []string `json:"scopes,omitempty"`
+}
+
+// Session is a refresh token family as seen by its owner: one login on one
+// device, kept alive by refreshing.
+type Session struct {
+	ID string
+	Client
+	// ClientID is set for sessions of OAuth clients
+	ClientID   string
+	CreatedAt  time.Time
+	LastUsedAt time.Time
+}
+
+// PasswordReset is a single-use password reset token, stored by the SHA-256
+// hash of its value.
+type PasswordReset struct {
+	Hash   string `json:"hash"`
+	UserID int    `json:"user_id"`
+	// Email is the address the token was sent to
+	Email     string    `json:"email"`
+	CreatedAt time.Time `json:"created_at"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+// PersonalToken is a long-lived, scoped token for scripts and integrations,
+// stored by the SHA-256 hash of its value.
+type PersonalToken struct {
+	ID         string     `json:"id"`
+	Hash       string     `json:"hash"`
+	UserID     int        `json:"user_id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at,omitempty"`
+	LastUsedAt *time.Time `json:"last_used_at,omitempty"`
+}
+
+// OAuthClient is a third-party application registered by a user. Public
+// clients, such as mobile apps, have no secret and rely on PKCE alone.
+type OAuthClient struct {
+	ID           string    `json:"id"`
+	SecretHash   string    `json:"secret_hash,omitempty"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	OwnerID      int       `json:"owner_id"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+func (c *OAuthClient) Confidential() bool {
+	return c.SecretHash != ""
+}
+
+// CheckSecret reports whether secret is the client's secret.
+func (c *OAuthClient) CheckSecret(secret string) bool {
+	return c.Confidential() && subtle.ConstantTimeCompare([]byte(hashToken(secret)), []byte(c.SecretHash)) == 1
+}
+
+// OAuthCode is an authorization code awaiting exchange, stored by the
+// SHA-256 hash of its value. Exchanged codes are kept until they expire, so
+// that presenting one again can revoke the session it started.
+type OAuthCode struct {
+	Hash   string `json:"hash"`
+	UserID int    `json:"user_id"`
+	Grant
+	RedirectURI string `json:"redirect_uri"`
+	// CodeChallenge is the PKCE S256 challenge the exchange must answer
+	CodeChallenge string `json:"code_challenge"`
+	// TokenVersion is the user's token version when the code was issued
+	TokenVersion int        `json:"token_version,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	ExpiresAt    time.Time  `json:"expires_at"`
+	UsedAt       *time.Time `json:"used_at,omitempty"`
+	// FamilyID is the refresh token family the code was exchanged for
+	FamilyID string `json:"family_id,omitempty"`
+}
+
+// lastUsedResolution limits how often using a personal token rewrites the
+// database just to move its last-used time.
+const lastUsedResolution time.Duration = time.Minute
+
+var (
+	ErrUserNotFound          = errors.New("User not found in database")
+	ErrEmailInUse            = errors.New("email is already in use")
+	ErrRefreshTokenInvalid   = errors.New("refresh token is invalid")
+	ErrRefreshTokenReused    = errors.New("refresh token was already used")
+	ErrSessionNotFound       = errors.New("Session not found")
+	ErrPasswordResetInvalid  = errors.New("password reset token is invalid or has expired")
+	ErrPersonalTokenInvalid  = errors.New("personal access token is invalid or has expired")
+	ErrPersonalTokenNotFound = errors.New("Personal access token not found")
+	ErrOAuthClientNotFound   = errors.New("OAuth client not found")
+	ErrOAuthCodeInvalid      = errors.New("authorization code is invalid or has expired")
+	ErrOAuthCodeReused       = errors.New("authorization code was already used")
+	ErrChallengeUsed         = errors.New("login challenge was already used")
+	ErrExportPending         = errors.New("an export is already in progress")
+)
+
 type DB struct {
 	path string
-	mu   sync.Mutex
+	mu   sync.RWMutex
+	now  func() time.Time
 }
 
+// errUnchanged is returned from an update to skip writing the database.
+var errUnchanged = errors.New("database unchanged")
+
 type DBStructure struct {
-	Chirps        map[int]Chirp        `json:"chirps"`
-	ChirpSeq      int                  `json:"chirp_seq"`
-	Users         map[int]User         `json:"users"`
-	RevokedTokens map[string]time.Time `json:"revoked_tokens"`
+	Chirps         map[int]Chirp            `json:"chirps"`
+	ChirpSeq       int                      `json:"chirp_seq"`
+	Users          map[int]User             `json:"users"`
+	UserSeq        int                      `json:"user_seq"`
+	RefreshTokens  map[string]RefreshToken  `json:"refresh_tokens"`
+	Exports        map[string]Export        `json:"exports"`
+	PasswordResets map[string]PasswordReset `json:"password_resets"`
+	PersonalTokens map[string]PersonalToken `json:"personal_tokens"`
+	OAuthClients   map[string]OAuthClient   `json:"oauth_clients"`
+	OAuthCodes     map[string]OAuthCode     `json:"oauth_codes"`
+	// UsedChallenges holds the IDs of login challenges already exchanged,
+	// until they expire
+	UsedChallenges map[string]time.Time `json:"used_challenges"`
+	AuditLog       []AuditEntry         `json:"audit_log"`
 }
 
 func (db *DB) ensureDB() error {
-	_, err := os.ReadFile(dbPath)
-	if err != nil {
-		_, err = os.Create(dbPath)
-		if err != nil {
-			return err
-		}
-		err = db.writeDB(DBStructure{
-			Chirps:        map[int]Chirp{},
-			ChirpSeq:      1,
-			Users:         map[int]User{},
-			RevokedTokens: map[string]time.Time{},
+	_, err := os.Stat(db.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return db.write(&DBStructure{
+			Chirps:         map[int]Chirp{},
+			ChirpSeq:       1,
+			Users:          map[int]User{},
+			UserSeq:        1,
+			RefreshTokens:  map[string]RefreshToken{},
+			Exports:        map[string]Export{},
+			PasswordResets: map[string]PasswordReset{},
+			PersonalTokens: map[string]PersonalToken{},
+			OAuthClients:   map[string]OAuthClient{},
+			OAuthCodes:     map[string]OAuthCode{},
+			UsedChallenges: map[string]time.Time{},
 		})
-		if err != nil {
-			return err
-		}
 	}
-	return nil
+	return err
 }
 
+// loadDB reads a snapshot of the database for reading. Changes made to it
+// are not saved; use update for that.
 func (db *DB) loadDB() (*DBStructure, error) {
-	db.mu.Lock()
-	defer db.mu.Unlock()
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	return db.read()
+}
+
+// read loads the database; the caller holds the lock.
+func (db *DB) read() (*DBStructure, error) {
+	defer metrics.ObserveDB("load", time.Now())
 	bytes, err := os.ReadFile(db.path)
 	if err != nil {
 		return nil, err
@@ -109,36 +373,91 @@ func (db *DB) loadDB() (*DBStructure, error) {
 	if err != nil {
 		return nil, err
 	}
+	// databases written by older versions lack the newer tables
+	if dbs.Exports == nil {
+		dbs.Exports = map[string]Export{}
+	}
+	if dbs.RefreshTokens == nil {
+		dbs.RefreshTokens = map[string]RefreshToken{}
+	}
+	if dbs.PasswordResets == nil {
+		dbs.PasswordResets = map[string]PasswordReset{}
+	}
+	if dbs.PersonalTokens == nil {
+		dbs.PersonalTokens = map[string]PersonalToken{}
+	}
+	if dbs.OAuthClients == nil {
+		dbs.OAuthClients = map[string]OAuthClient{}
+	}
+	if dbs.OAuthCodes == nil {
+		dbs.OAuthCodes = map[string]OAuthCode{}
+	}
+	if dbs.UsedChallenges == nil {
+		dbs.UsedChallenges = map[string]time.Time{}
+	}
 	return &dbs, nil
 }
 
-func (db *DB) writeDB(dbStructure DBStructure) error {
+// update loads the database, applies fn to it and writes the result back,
+// holding the lock throughout so that concurrent changes cannot overwrite
+// each other. Nothing is written when fn returns an error, and
+// errUnchanged skips the write without failing the update.
+func (db *DB) update(fn func(dbs *DBStructure) error) error {
 	db.mu.Lock()
 	defer db.mu.Unlock()
-	bytes, err := json.Marshal(dbStructure)
+	dbs, err := db.read()
 	if err != nil {
 		return err
 	}
-	err = os.WriteFile(db.path, bytes, os.FileMode(int(0777)))
+	err = fn(dbs)
+	if errors.Is(err, errUnchanged) {
+		return nil
+	}
 	if err != nil {
 		return err
 	}
-	return nil
+	return db.write(dbs)
 }
 
-func (db *DB) CreateChirp(body string, author int) (*Chirp, error) {
-	dbs, err := db.loadDB()
+// write saves the database; the caller holds the lock. The new contents go
+// to a temporary file that is renamed over the old one, so a crash leaves
+// either the old or the new database but never a partial one.
+func (db *DB) write(dbs *DBStructure) error {
+	defer metrics.ObserveDB("write", time.Now())
+	bytes, err := json.Marshal(dbs)
 	if err != nil {
-		return nil, err
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(db.path), filepath.Base(db.path)+".*.tmp")
+	if err != nil {
+		return err
 	}
+	defer os.Remove(f.Name())
+	_, err = f.Write(bytes)
+	if err == nil {
+		err = f.Sync()
+	}
+	closeErr := f.Close()
+	if err != nil {
+		return err
+	}
+	if closeErr != nil {
+		return closeErr
+	}
+	return os.Rename(f.Name(), db.path)
+}
+
+func (db *DB) CreateChirp(body string, author int) (*Chirp, error) {
 	chirp := Chirp{
 		Body:     body,
-		ID:       dbs.ChirpSeq,
 		AuthorID: author,
 	}
-	dbs.ChirpSeq += 1
-	dbs.Chirps[chirp.ID] = chirp
-	err = db.writeDB(*dbs)
+	err := db.update(func(dbs *DBStructure) error {
+		chirp.ID = dbs.ChirpSeq
+		dbs.ChirpSeq += 1
+		dbs.Chirps[chirp.ID] = chirp
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -146,16 +465,11 @@ func (db *DB) CreateChirp(body string, author int) (*Chirp, error) {
 }
 
 func (db *DB) DeleteChirp(id int) bool {
-	dbs, err := db.loadDB()
-	if err != nil {
-		return false
-	}
-	delete(dbs.Chirps, id)
-	err = db.writeDB(*dbs)
-	if err != nil {
-		return false
-	}
-	return true
+	err := db.update(func(dbs *DBStructure) error {
+		delete(dbs.Chirps, id)
+		return nil
+	})
+	return err == nil
 }
 
 func (db *DB) GetChirps() ([]Chirp, error) {
@@ -165,8 +479,15 @@ func (db *DB) GetChirps() ([]Chirp, error) {
 	}
 	chirps := []Chirp{}
 	for _, val := range dbs.Chirps {
+		if dbs.authorDeleted(val) {
+			continue
+		}
 		chirps = append(chirps, val)
 	}
+	// oldest first
+	sort.Slice(chirps, func(i, j int) bool {
+		return chirps[i].ID < chirps[j].ID
+	})
 	return chirps, nil
 }
 
@@ -176,33 +497,48 @@ func (db *DB) GetChirp(id int) (*Chirp, error) {
 		return nil, err
 	}
 	val, ok := dbs.Chirps[id]
-	if !ok {
+	if !ok || dbs.authorDeleted(val) {
 		return nil, errors.New("Chirp not found in database")
 	}
 	return &val, nil
 }
 
-func (db *DB) CreateUser(email string, password string) (*User, error) {
-	dbs, err := db.loadDB()
+func (db *DB) CreateUser(email string, plaintext string, p *password.Policy) (*User, error) {
+	hash, err := p.Hash(plaintext)
 	if err != nil {
 		return nil, err
 	}
-	user, err := db.GetUserByEmail(email)
-	if err == nil && user != nil {
-		return nil, errors.New("User already exists")
-	}
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 4)
-	if err != nil {
-		return nil, err
-	}
-	user = &User{
-		Email:       email,
-		ID:          len(dbs.Users) + 1,
-		Password:    string(hash),
+	user := &User{
+		Email:       mail.Normalize(email),
+		Password:    hash,
 		IsChirpyRed: false,
+		Settings: UserSettings{
+			DefaultChirpSort: "asc",
+		},
+		EmailUnverified: true,
+		CreatedAt:       db.now(),
 	}
-	dbs.Users[user.ID] = *user
-	err = db.writeDB(*dbs)
+	err = db.update(func(dbs *DBStructure) error {
+		for _, v := range dbs.Users {
+			if mail.Normalize(v.Email) == user.Email {
+				return ErrEmailInUse
+			}
+		}
+		if dbs.UserSeq < 1 {
+			// databases written before user_seq existed; ID 0 is kept for
+			// the author of anonymised chirps
+			dbs.UserSeq = 1
+			for id := range dbs.Users {
+				if id >= dbs.UserSeq {
+					dbs.UserSeq = id + 1
+				}
+			}
+		}
+		user.ID = dbs.UserSeq
+		dbs.UserSeq = user.ID + 1
+		dbs.Users[user.ID] = *user
+		return nil
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -216,66 +552,901 @@ func (db *DB) GetUser(id int) (*User, error) {
 	}
 	val, ok := dbs.Users[id]
 	if !ok {
-		return nil, errors.New("User not found in database")
+		return nil, ErrUserNotFound
 	}
 	return &val, nil
 }
 
+// GetUserByEmail finds a user by email, ignoring case and surrounding
+// space. Accounts created before emails were normalised may differ in
+// case, so an exact match is preferred.
 func (db *DB) GetUserByEmail(email string) (*User, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
 		return nil, err
 	}
+	var found *User
 	for _, v := range dbs.Users {
 		if v.Email == email {
 			return &v, nil
 		}
+		if found == nil && mail.Normalize(v.Email) == mail.Normalize(email) {
+			found = &v
+		}
+	}
+	if found == nil {
+		return nil, errors.New("User not found")
+	}
+	return found, nil
+}
+
+// UpdateUser applies fn to the stored user and saves the result, holding
+// the lock throughout so that concurrent changes to the user are not lost.
+// Nothing is saved when fn returns an error, which is passed on. A new
+// email must not belong to another user, and voids the password resets
+// sent to the old one.
+func (db *DB) UpdateUser(id int, fn func(u *User) error) (*User, error) {
+	user := User{}
+	err := db.update(func(dbs *DBStructure) error {
+		var err error
+		user, err = dbs.updateUser(id, fn)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// updateUser is UpdateUser within an update.
+func (dbs *DBStructure) updateUser(id int, fn func(u *User) error) (User, error) {
+	user, ok := dbs.Users[id]
+	if !ok {
+		return User{}, ErrUserNotFound
+	}
+	oldEmail := user.Email
+	err := fn(&user)
+	if err != nil {
+		return User{}, err
+	}
+	if user.Email != oldEmail {
+		user.Email = mail.Normalize(user.Email)
+		for otherID, other := range dbs.Users {
+			if otherID != id && mail.Normalize(other.Email) == user.Email {
+				return User{}, ErrEmailInUse
+			}
+		}
+		for hash, pr := range dbs.PasswordResets {
+			if pr.UserID == id {
+				delete(dbs.PasswordResets, hash)
+			}
+		}
+	}
+	user.ID = id
+	dbs.Users[id] = user
+	return user, nil
+}
+
+// PurgeDeletedUsers removes every account deleted before cutoff, applying
+// policy to its chirps, along with everything else held about it. It
+// returns how many accounts were removed and their exports, whose archives
+// the caller deletes.
+func (db *DB) PurgeDeletedUsers(cutoff time.Time, policy ChirpPolicy) (int, []Export, error) {
+	purged := map[int]bool{}
+	exports := []Export{}
+	err := db.update(func(dbs *DBStructure) error {
+		for id, user := range dbs.Users {
+			if user.DeletedAt != nil && user.DeletedAt.Before(cutoff) {
+				purged[id] = true
+				delete(dbs.Users, id)
+			}
+		}
+		if len(purged) == 0 {
+			return errUnchanged
+		}
+		for id, chirp := range dbs.Chirps {
+			if !purged[chirp.AuthorID] {
+				continue
+			}
+			if policy == ChirpPolicyAnonymise {
+				chirp.AuthorID = 0
+				dbs.Chirps[id] = chirp
+			} else {
+				delete(dbs.Chirps, id)
+			}
+		}
+		for hash, rt := range dbs.RefreshTokens {
+			if purged[rt.UserID] {
+				delete(dbs.RefreshTokens, hash)
+			}
+		}
+		for id, export := range dbs.Exports {
+			if purged[export.UserID] {
+				exports = append(exports, export)
+				delete(dbs.Exports, id)
+			}
+		}
+		for hash, pr := range dbs.PasswordResets {
+			if purged[pr.UserID] {
+				delete(dbs.PasswordResets, hash)
+			}
+		}
+		for hash, pt := range dbs.PersonalTokens {
+			if purged[pt.UserID] {
+				delete(dbs.PersonalTokens, hash)
+			}
+		}
+		for hash, oc := range dbs.OAuthCodes {
+			if purged[oc.UserID] {
+				delete(dbs.OAuthCodes, hash)
+			}
+		}
+		for id, c := range dbs.OAuthClients {
+			if purged[c.OwnerID] {
+				delete(dbs.OAuthClients, id)
+				for hash, oc := range dbs.OAuthCodes {
+					if oc.ClientID == id {
+						delete(dbs.OAuthCodes, hash)
+					}
+				}
+				dbs.revokeRefreshTokens(db.now(), func(t RefreshToken) bool {
+					return t.ClientID == id
+				})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return len(purged), exports, nil
+}
+
+// CreateRefreshToken issues a refresh token starting a new family and
+// returns its value, which is not stored anywhere.
+func (db *DB) CreateRefreshToken(userID int, client Client, grant Grant, ttl time.Duration) (string, error) {
+	family, err := newID()
+	if err != nil {
+		return "", err
+	}
+	var token string
+	err = db.update(func(dbs *DBStructure) error {
+		now := db.now()
+		token, err = dbs.addRefreshToken(userID, family, client, grant, now, now, ttl)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// RotateRefreshToken exchanges a refresh token for a new one in the same
+// family, recording the client's current address. Only tokens granted to
+// clientID are accepted, "" for first-party logins. A token that was already
+// exchanged revokes its family and returns ErrRefreshTokenReused, as it has
+// most likely been stolen.
+func (db *DB) RotateRefreshToken(token string, clientID string, client Client, ttl time.Duration) (string, *RefreshToken, error) {
+	var next string
+	var rt RefreshToken
+	reused := false
+	err := db.update(func(dbs *DBStructure) error {
+		now := db.now()
+		var ok bool
+		rt, ok = dbs.RefreshTokens[hashToken(token)]
+		if !ok || rt.RevokedAt != nil || now.After(rt.ExpiresAt) || rt.ClientID != clientID {
+			return ErrRefreshTokenInvalid
+		}
+		if rt.UsedAt != nil {
+			// the revocation is saved before the error is returned
+			reused = true
+			dbs.revokeRefreshTokens(now, func(t RefreshToken) bool {
+				return t.FamilyID == rt.FamilyID
+			})
+			return nil
+		}
+		rt.UsedAt = &now
+		dbs.RefreshTokens[rt.Hash] = rt
+		// the device label belongs to the session and is kept
+		client.Device = rt.Device
+		var err error
+		next, err = dbs.addRefreshToken(rt.UserID, rt.FamilyID, client, rt.Grant, rt.SessionCreatedAt, now, ttl)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if reused {
+		return "", nil, ErrRefreshTokenReused
+	}
+	return next, &rt, nil
+}
+
+// RevokeRefreshToken revokes the family a refresh token belongs to.
+func (db *DB) RevokeRefreshToken(token string) error {
+	return db.update(func(dbs *DBStructure) error {
+		rt, ok := dbs.RefreshTokens[hashToken(token)]
+		if !ok {
+			return ErrRefreshTokenInvalid
+		}
+		dbs.revokeRefreshTokens(db.now(), func(t RefreshToken) bool {
+			return t.FamilyID == rt.FamilyID
+		})
+		return nil
+	})
+}
+
+// RevokeUserRefreshTokens revokes every refresh token held by a user.
+func (db *DB) RevokeUserRefreshTokens(userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		dbs.revokeRefreshTokens(db.now(), func(t RefreshToken) bool {
+			return t.UserID == userID
+		})
+		return nil
+	})
+}
+
+// GetSessions lists a user's active sessions, most recently used first. Each
+// is represented by the one token of its family that has not been exchanged.
+func (db *DB) GetSessions(userID int) ([]Session, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	now := db.now()
+	sessions := []Session{}
+	for _, rt := range dbs.RefreshTokens {
+		if rt.UserID != userID || rt.UsedAt != nil || rt.RevokedAt != nil || now.After(rt.ExpiresAt) {
+			continue
+		}
+		sessions = append(sessions, Session{
+			ID:         rt.FamilyID,
+			Client:     rt.Client,
+			ClientID:   rt.ClientID,
+			CreatedAt:  rt.SessionCreatedAt,
+			LastUsedAt: rt.CreatedAt,
+		})
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return sessions[i].LastUsedAt.After(sessions[j].LastUsedAt)
+	})
+	return sessions, nil
+}
+
+// RevokeSession revokes one of the user's sessions by its family ID.
+func (db *DB) RevokeSession(userID int, id string) error {
+	return db.update(func(dbs *DBStructure) error {
+		found := false
+		for _, rt := range dbs.RefreshTokens {
+			if rt.UserID == userID && rt.FamilyID == id && rt.RevokedAt == nil {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return ErrSessionNotFound
+		}
+		dbs.revokeRefreshTokens(db.now(), func(t RefreshToken) bool {
+			return t.FamilyID == id
+		})
+		return nil
+	})
+}
+
+// DeleteExpiredRefreshTokens forgets refresh tokens that can no longer be used.
+func (db *DB) DeleteExpiredRefreshTokens(now time.Time) error {
+	return db.update(func(dbs *DBStructure) error {
+		for hash, rt := range dbs.RefreshTokens {
+			if now.After(rt.ExpiresAt) {
+				delete(dbs.RefreshTokens, hash)
+			}
+		}
+		return nil
+	})
+}
+
+func (dbs *DBStructure) addRefreshToken(userID int, family string, client Client, grant Grant, sessionCreatedAt time.Time, now time.Time, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	rt := RefreshToken{
+		Hash:             hashToken(token),
+		UserID:           userID,
+		FamilyID:         family,
+		Client:           client,
+		Grant:            grant,
+		SessionCreatedAt: sessionCreatedAt,
+		CreatedAt:        now,
+		ExpiresAt:        now.Add(ttl),
+	}
+	dbs.RefreshTokens[rt.Hash] = rt
+	return token, nil
+}
+
+func (dbs *DBStructure) revokeRefreshTokens(now time.Time, match func(RefreshToken) bool) {
+	for hash, rt := range dbs.RefreshTokens {
+		if rt.RevokedAt == nil && match(rt) {
+			rt.RevokedAt = &now
+			dbs.RefreshTokens[hash] = rt
+		}
+	}
+}
+
+// CreatePasswordReset issues a password reset token for a user, to be sent
+// to email, and returns its value. Tokens issued to the user before stop
+// working.
+func (db *DB) CreatePasswordReset(userID int, email string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	err = db.update(func(dbs *DBStructure) error {
+		dbs.deletePasswordResets(userID)
+		now := db.now()
+		pr := PasswordReset{
+			Hash:      hashToken(token),
+			UserID:    userID,
+			Email:     email,
+			CreatedAt: now,
+			ExpiresAt: now.Add(ttl),
+		}
+		dbs.PasswordResets[pr.Hash] = pr
+		return nil
+	})
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+// UsePasswordReset consumes a password reset token and returns it. Checking
+// and consuming the token is one update, so it can only be used once.
+func (db *DB) UsePasswordReset(token string) (*PasswordReset, error) {
+	var pr PasswordReset
+	err := db.update(func(dbs *DBStructure) error {
+		var ok bool
+		pr, ok = dbs.PasswordResets[hashToken(token)]
+		if !ok || db.now().After(pr.ExpiresAt) {
+			return ErrPasswordResetInvalid
+		}
+		delete(dbs.PasswordResets, pr.Hash)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &pr, nil
+}
+
+// DeletePasswordResets invalidates every password reset token issued to a
+// user.
+func (db *DB) DeletePasswordResets(userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		dbs.deletePasswordResets(userID)
+		return nil
+	})
+}
+
+func (dbs *DBStructure) deletePasswordResets(userID int) {
+	for hash, pr := range dbs.PasswordResets {
+		if pr.UserID == userID {
+			delete(dbs.PasswordResets, hash)
+		}
+	}
+}
+
+// DeleteExpiredPasswordResets forgets password reset tokens that can no
+// longer be used.
+func (db *DB) DeleteExpiredPasswordResets(now time.Time) error {
+	return db.update(func(dbs *DBStructure) error {
+		for hash, pr := range dbs.PasswordResets {
+			if now.After(pr.ExpiresAt) {
+				delete(dbs.PasswordResets, hash)
+			}
+		}
+		return nil
+	})
+}
+
+// UseLoginChallenge exchanges the login challenge with the given ID for the
+// user, applying fn to check and use up their second factor as UpdateUser
+// does. The challenge is used and the user saved together, and only when fn
+// succeeds, so that neither a challenge nor a code can be spent twice. It
+// returns ErrChallengeUsed if the challenge already was used. The ID is
+// kept until the challenge expires.
+func (db *DB) UseLoginChallenge(id string, expiresAt time.Time, userID int, fn func(u *User) error) (*User, error) {
+	user := User{}
+	err := db.update(func(dbs *DBStructure) error {
+		if _, ok := dbs.UsedChallenges[id]; ok {
+			return ErrChallengeUsed
+		}
+		var err error
+		user, err = dbs.updateUser(userID, fn)
+		if err != nil {
+			return err
+		}
+		dbs.UsedChallenges[id] = expiresAt
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &user, nil
+}
+
+// DeleteExpiredLoginChallenges forgets used login challenges that could no
+// longer be presented anyway.
+func (db *DB) DeleteExpiredLoginChallenges(now time.Time) error {
+	return db.update(func(dbs *DBStructure) error {
+		changed := false
+		for id, expiresAt := range dbs.UsedChallenges {
+			if now.After(expiresAt) {
+				delete(dbs.UsedChallenges, id)
+				changed = true
+			}
+		}
+		if !changed {
+			return errUnchanged
+		}
+		return nil
+	})
+}
+
+// CreatePersonalToken issues a personal access token and returns its value,
+// which is not stored anywhere, along with its record.
+func (db *DB) CreatePersonalToken(userID int, name string, scopes []string, expiresAt *time.Time) (string, *PersonalToken, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, err
+	}
+	token := auth.PersonalTokenPrefix + base64.RawURLEncoding.EncodeToString(b)
+	id, err := newID()
+	if err != nil {
+		return "", nil, err
+	}
+	pt := PersonalToken{
+		ID:        id,
+		Hash:      hashToken(token),
+		UserID:    userID,
+		Name:      name,
+		Scopes:    scopes,
+		CreatedAt: db.now(),
+		ExpiresAt: expiresAt,
+	}
+	err = db.update(func(dbs *DBStructure) error {
+		dbs.PersonalTokens[pt.Hash] = pt
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return token, &pt, nil
+}
+
+// UsePersonalToken looks up a personal access token and records that it
+// was used. The last-used time moves at most once per lastUsedResolution,
+// so most requests made with the token do not write to the database.
+func (db *DB) UsePersonalToken(token string) (*PersonalToken, error) {
+	var pt PersonalToken
+	err := db.update(func(dbs *DBStructure) error {
+		now := db.now()
+		var ok bool
+		pt, ok = dbs.PersonalTokens[hashToken(token)]
+		if !ok || (pt.ExpiresAt != nil && now.After(*pt.ExpiresAt)) {
+			return ErrPersonalTokenInvalid
+		}
+		if pt.LastUsedAt != nil && now.Sub(*pt.LastUsedAt) < lastUsedResolution {
+			return errUnchanged
+		}
+		pt.LastUsedAt = &now
+		dbs.PersonalTokens[pt.Hash] = pt
+		return nil
+	})
+	if err != nil {
+		return nil, err
 	}
-	return nil, errors.New("User not found")
+	return &pt, nil
 }
 
-func (db *DB) UpdateUser(u *User) (*User, error) {
+// GetPersonalTokens lists a user's personal access tokens, newest first.
+func (db *DB) GetPersonalTokens(userID int) ([]PersonalToken, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
 		return nil, err
 	}
-	dbs.Users[*&u.ID] = *u
-	err = db.writeDB(*dbs)
+	tokens := []PersonalToken{}
+	for _, pt := range dbs.PersonalTokens {
+		if pt.UserID == userID {
+			tokens = append(tokens, pt)
+		}
+	}
+	sort.Slice(tokens, func(i, j int) bool {
+		return tokens[i].CreatedAt.After(tokens[j].CreatedAt)
+	})
+	return tokens, nil
+}
+
+// DeletePersonalTokens revokes every personal access token a user holds.
+func (db *DB) DeletePersonalTokens(userID int) error {
+	return db.update(func(dbs *DBStructure) error {
+		for hash, pt := range dbs.PersonalTokens {
+			if pt.UserID == userID {
+				delete(dbs.PersonalTokens, hash)
+			}
+		}
+		return nil
+	})
+}
+
+// DeletePersonalToken revokes one of the user's personal access tokens.
+func (db *DB) DeletePersonalToken(userID int, id string) error {
+	return db.update(func(dbs *DBStructure) error {
+		for hash, pt := range dbs.PersonalTokens {
+			if pt.UserID == userID && pt.ID == id {
+				delete(dbs.PersonalTokens, hash)
+				return nil
+			}
+		}
+		return ErrPersonalTokenNotFound
+	})
+}
+
+// CreateOAuthClient registers a client and returns its secret, which is
+// not stored anywhere, or "" for a public client.
+func (db *DB) CreateOAuthClient(ownerID int, name string, redirectURIs []string, scopes []string, confidential bool) (string, *OAuthClient, error) {
+	id, err := newID()
+	if err != nil {
+		return "", nil, err
+	}
+	c := OAuthClient{
+		ID:           id,
+		Name:         name,
+		RedirectURIs: redirectURIs,
+		Scopes:       scopes,
+		OwnerID:      ownerID,
+		CreatedAt:    db.now(),
+	}
+	secret := ""
+	if confidential {
+		b := make([]byte, 32)
+		_, err = rand.Read(b)
+		if err != nil {
+			return "", nil, err
+		}
+		secret = base64.RawURLEncoding.EncodeToString(b)
+		c.SecretHash = hashToken(secret)
+	}
+	err = db.update(func(dbs *DBStructure) error {
+		dbs.OAuthClients[c.ID] = c
+		return nil
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	return secret, &c, nil
+}
+
+func (db *DB) GetOAuthClient(id string) (*OAuthClient, error) {
+	dbs, err := db.loadDB()
 	if err != nil {
 		return nil, err
 	}
-	return u, nil
+	c, ok := dbs.OAuthClients[id]
+	if !ok {
+		return nil, ErrOAuthClientNotFound
+	}
+	return &c, nil
 }
 
-func (db *DB) RevokeToken(token string) error {
+// GetOAuthClients lists the clients a user registered, newest first.
+func (db *DB) GetOAuthClients(ownerID int) ([]OAuthClient, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
-		return err
+		return nil, err
+	}
+	clients := []OAuthClient{}
+	for _, c := range dbs.OAuthClients {
+		if c.OwnerID == ownerID {
+			clients = append(clients, c)
+		}
+	}
+	sort.Slice(clients, func(i, j int) bool {
+		return clients[i].CreatedAt.After(clients[j].CreatedAt)
+	})
+	return clients, nil
+}
+
+// DeleteOAuthClient removes one of the user's clients, along with every
+// code and refresh token issued to it.
+func (db *DB) DeleteOAuthClient(ownerID int, id string) error {
+	return db.update(func(dbs *DBStructure) error {
+		c, ok := dbs.OAuthClients[id]
+		if !ok || c.OwnerID != ownerID {
+			return ErrOAuthClientNotFound
+		}
+		delete(dbs.OAuthClients, id)
+		for hash, code := range dbs.OAuthCodes {
+			if code.ClientID == id {
+				delete(dbs.OAuthCodes, hash)
+			}
+		}
+		dbs.revokeRefreshTokens(db.now(), func(t RefreshToken) bool {
+			return t.ClientID == id
+		})
+		return nil
+	})
+}
+
+// CreateOAuthCode issues an authorization code and returns its value.
+func (db *DB) CreateOAuthCode(userID int, grant Grant, redirectURI string, codeChallenge string, ttl time.Duration) (string, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
 	}
-	dbs.RevokedTokens[token] = time.Now()
-	err = db.writeDB(*dbs)
+	code := base64.RawURLEncoding.EncodeToString(b)
+	err = db.update(func(dbs *DBStructure) error {
+		u, ok := dbs.Users[userID]
+		if !ok {
+			return errors.New("User not found in database")
+		}
+		now := db.now()
+		oc := OAuthCode{
+			Hash:          hashToken(code),
+			UserID:        userID,
+			Grant:         grant,
+			RedirectURI:   redirectURI,
+			CodeChallenge: codeChallenge,
+			TokenVersion:  u.TokenVersion,
+			CreatedAt:     now,
+			ExpiresAt:     now.Add(ttl),
+		}
+		dbs.OAuthCodes[oc.Hash] = oc
+		return nil
+	})
 	if err != nil {
-		return err
+		return "", err
 	}
-	return nil
+	return code, nil
+}
 
+// ExchangeOAuthCode redeems an authorization code issued to clientID for a
+// refresh token starting a new family, and returns its value. verify checks
+// the parts of the request only the caller knows about, such as the PKCE
+// verifier; its error is returned as is. The code can be presented once:
+// it is used up whether or not the exchange succeeds, and presenting it
+// again revokes the family it was exchanged for and returns
+// ErrOAuthCodeReused. Codes issued before the user's tokens were revoked
+// are rejected.
+func (db *DB) ExchangeOAuthCode(code string, clientID string, client Client, ttl time.Duration, verify func(*OAuthCode) error) (string, *OAuthCode, error) {
+	family, err := newID()
+	if err != nil {
+		return "", nil, err
+	}
+	var token string
+	var oc OAuthCode
+	// failures after the code is used up are saved before being returned
+	var failed error
+	err = db.update(func(dbs *DBStructure) error {
+		now := db.now()
+		var ok bool
+		oc, ok = dbs.OAuthCodes[hashToken(code)]
+		if !ok {
+			return ErrOAuthCodeInvalid
+		}
+		if oc.UsedAt != nil {
+			failed = ErrOAuthCodeReused
+			if oc.FamilyID == "" {
+				return errUnchanged
+			}
+			dbs.revokeRefreshTokens(now, func(t RefreshToken) bool {
+				return t.FamilyID == oc.FamilyID
+			})
+			return nil
+		}
+		oc.UsedAt = &now
+		dbs.OAuthCodes[oc.Hash] = oc
+		u, ok := dbs.Users[oc.UserID]
+		if oc.ClientID != clientID || now.After(oc.ExpiresAt) || !ok || u.Deleted() || u.TokenRevoked(oc.CreatedAt, oc.TokenVersion) {
+			failed = ErrOAuthCodeInvalid
+			return nil
+		}
+		failed = verify(&oc)
+		if failed != nil {
+			return nil
+		}
+		oc.FamilyID = family
+		dbs.OAuthCodes[oc.Hash] = oc
+		token, err = dbs.addRefreshToken(oc.UserID, family, client, oc.Grant, now, now, ttl)
+		return err
+	})
+	if err != nil {
+		return "", nil, err
+	}
+	if failed != nil {
+		return "", nil, failed
+	}
+	return token, &oc, nil
 }
 
-func (db *DB) ValidateToken(token string) (bool, error) {
+// SessionActive reports whether a session of the user, named by its family
+// ID, can still be refreshed.
+func (db *DB) SessionActive(userID int, id string) (bool, error) {
 	dbs, err := db.loadDB()
 	if err != nil {
 		return false, err
 	}
-	_, ok := dbs.RevokedTokens[token]
-	if ok {
-		return false, nil
+	now := db.now()
+	for _, rt := range dbs.RefreshTokens {
+		if rt.UserID == userID && rt.FamilyID == id && rt.RevokedAt == nil && !now.After(rt.ExpiresAt) {
+			return true, nil
+		}
 	}
-	return true, nil
+	return false, nil
 }
 
-func NewDB() (*DB, error) {
+// DeleteExpiredOAuthCodes forgets authorization codes that were never
+// exchanged.
+func (db *DB) DeleteExpiredOAuthCodes(now time.Time) error {
+	return db.update(func(dbs *DBStructure) error {
+		for hash, oc := range dbs.OAuthCodes {
+			if now.After(oc.ExpiresAt) {
+				delete(dbs.OAuthCodes, hash)
+			}
+		}
+		return nil
+	})
+}
+
+// GetRefreshToken looks up a refresh token that can still be exchanged.
+func (db *DB) GetRefreshToken(token string) (*RefreshToken, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	rt, ok := dbs.RefreshTokens[hashToken(token)]
+	if !ok || rt.UsedAt != nil || rt.RevokedAt != nil || db.now().After(rt.ExpiresAt) {
+		return nil, ErrRefreshTokenInvalid
+	}
+	return &rt, nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// GetUserData reads a user and all of their chirps from a single load of the
+// database, so the two are consistent with each other.
+func (db *DB) GetUserData(id int) (*UserData, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	user, ok := dbs.Users[id]
+	if !ok {
+		return nil, errors.New("User not found in database")
+	}
+	data := UserData{
+		User:   user,
+		Chirps: []Chirp{},
+	}
+	for _, chirp := range dbs.Chirps {
+		if chirp.AuthorID == id {
+			data.Chirps = append(data.Chirps, chirp)
+		}
+	}
+	sort.Slice(data.Chirps, func(i, j int) bool {
+		return data.Chirps[i].ID < data.Chirps[j].ID
+	})
+	return &data, nil
+}
+
+// CreateExport starts an export job for the user, returning
+// ErrExportPending while one started less than stale ago is still pending.
+// Older pending jobs were abandoned, e.g. by a restart, and do not count.
+func (db *DB) CreateExport(userID int, stale time.Duration) (*Export, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	export := Export{
+		ID:        id,
+		UserID:    userID,
+		Status:    ExportPending,
+		CreatedAt: db.now(),
+	}
+	err = db.update(func(dbs *DBStructure) error {
+		for _, e := range dbs.Exports {
+			if e.UserID == userID && e.Status == ExportPending && export.CreatedAt.Sub(e.CreatedAt) < stale {
+				return ErrExportPending
+			}
+		}
+		dbs.Exports[id] = export
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return &export, nil
+}
+
+func (db *DB) GetExport(id string) (*Export, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	val, ok := dbs.Exports[id]
+	if !ok {
+		return nil, errors.New("Export not found in database")
+	}
+	return &val, nil
+}
+
+func (db *DB) UpdateExport(e *Export) (*Export, error) {
+	err := db.update(func(dbs *DBStructure) error {
+		dbs.Exports[e.ID] = *e
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// DeleteExpiredExports forgets every export that expired before now and
+// returns them so their archives can be removed.
+func (db *DB) DeleteExpiredExports(now time.Time) ([]Export, error) {
+	expired := []Export{}
+	err := db.update(func(dbs *DBStructure) error {
+		for id, export := range dbs.Exports {
+			if export.ExpiresAt != nil && export.ExpiresAt.Before(now) {
+				expired = append(expired, export)
+				delete(dbs.Exports, id)
+			}
+		}
+		if len(expired) == 0 {
+			return errUnchanged
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return expired, nil
+}
+
+// newID returns a random, unguessable identifier.
+func newID() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// authorDeleted reports whether the chirp's author is pending deletion.
+func (dbs *DBStructure) authorDeleted(chirp Chirp) bool {
+	author, ok := dbs.Users[chirp.AuthorID]
+	return ok && author.DeletedAt != nil
+}
+
+// NewDB opens the database file at path, creating it if needed. now is the
+// clock to use, time.Now when nil.
+func NewDB(path string, now func() time.Time) (*DB, error) {
+	if now == nil {
+		now = time.Now
+	}
 	db := DB{
-		path: dbPath,
+		path: path,
+		now:  now,
 	}
 	err := db.ensureDB()
 	if err != nil {
@@ -283,3 +1454,91 @@ func NewDB() (*DB, error) {
 	}
 	return &db, nil
 }
+
+// AuditEntry records an administrative action.
+type AuditEntry struct {
+	At time.Time `json:"at"`
+	// ActorID is the admin who acted, 0 when the admin API key was used
+	ActorID int    `json:"actor_id"`
+	Action  string `json:"action"`
+	// Target names what was acted on, e.g. "user:3"
+	Target string `json:"target,omitempty"`
+	// Detail describes the change, e.g. the new role
+	Detail string `json:"detail,omitempty"`
+	IP     string `json:"ip"`
+}
+
+// RecordAudit appends an entry to the audit log, stamping it with the
+// current time.
+func (db *DB) RecordAudit(entry AuditEntry) error {
+	return db.update(func(dbs *DBStructure) error {
+		entry.At = db.now()
+		dbs.AuditLog = append(dbs.AuditLog, entry)
+		return nil
+	})
+}
+
+// GetAuditLog returns up to limit entries, newest first.
+func (db *DB) GetAuditLog(limit int) ([]AuditEntry, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	entries := []AuditEntry{}
+	for i := len(dbs.AuditLog) - 1; i >= 0 && len(entries) < limit; i-- {
+		entries = append(entries, dbs.AuditLog[i])
+	}
+	return entries, nil
+}
+
+// Stats summarises the database for the admin area. Accounts pending
+// deletion are not counted.
+type Stats struct {
+	Users     int
+	Chirps    int
+	ChirpyRed int
+	// Signups counts new accounts on each of the last days, oldest first
+	Signups []DailyCount
+}
+
+type DailyCount struct {
+	// Day is a UTC date, e.g. "2024-05-01"
+	Day   string
+	Count int
+}
+
+// GetStats computes Stats with signups for the days days up to and
+// including now.
+func (db *DB) GetStats(now time.Time, days int) (*Stats, error) {
+	dbs, err := db.loadDB()
+	if err != nil {
+		return nil, err
+	}
+	stats := Stats{}
+	for _, c := range dbs.Chirps {
+		// chirps of accounts pending deletion are hidden, like the accounts
+		if !dbs.authorDeleted(c) {
+			stats.Chirps++
+		}
+	}
+	today := now.UTC().Truncate(time.Hour * 24)
+	first := today.AddDate(0, 0, 1-days)
+	index := map[string]int{}
+	for day := first; !day.After(today); day = day.AddDate(0, 0, 1) {
+		index[day.Format(time.DateOnly)] = len(stats.Signups)
+		stats.Signups = append(stats.Signups, DailyCount{Day: day.Format(time.DateOnly)})
+	}
+	for _, u := range dbs.Users {
+		if u.Deleted() {
+			continue
+		}
+		stats.Users++
+		if u.IsChirpyRed {
+			stats.ChirpyRed++
+		}
+		if i, ok := index[u.CreatedAt.UTC().Format(time.DateOnly)]; ok {
+			stats.Signups[i].Count++
+		}
+	}
+	return &stats, nil
+}
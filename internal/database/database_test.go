@@ -1,28 +1,32 @@
 package database_test
 
 import (
+	"errors"
 	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/password"
+	"golang.org/x/crypto/bcrypt"
 )
 
-var (
-	db *database.DB
-)
-
-func beforeEach() (*database.DB, error) {
-	os.Remove("../../database.json")
-	return database.NewDB()
+func beforeEach(t *testing.T) (*database.DB, string) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	db, err := database.NewDB(path, nil)
+	if db == nil || err != nil {
+		t.Fatalf("Failed: create method: %v", err)
+	}
+	return db, path
 }
 
 // creates a new database_test
 func TestCreateDatabase(t *testing.T) {
-	db, err := beforeEach()
-	if db == nil || err != nil {
-		t.Fatal("Failed: create method")
-	}
-	_, err = os.Open("../../database.json")
+	_, path := beforeEach(t)
+	_, err := os.Open(path)
 	if err != nil {
 		t.Fatalf("Test 'CreateDatabase' failed: %s", err.Error())
 	}
@@ -30,10 +34,10 @@ func TestCreateDatabase(t *testing.T) {
 
 // gets a new chirp from the create chirp function & tests reading chirps
 func TestCreateChirp(t *testing.T) {
-	db, err := beforeEach()
-	chirp, err := db.CreateChirp("wow a chirp!")
+	db, _ := beforeEach(t)
+	chirp, err := db.CreateChirp("wow a chirp!", 1)
 	if chirp == nil || err != nil {
-		t.Fatalf("Test 'CreateChirp' failed: %s", err.Error())
+		t.Fatalf("Test 'CreateChirp' failed: %v", err)
 	}
 	chirps, err := db.GetChirps()
 	if err != nil {
@@ -42,4 +46,682 @@ func TestCreateChirp(t *testing.T) {
 	if len(chirps) != 1 {
 		t.Fatalf("Test 'CreateChirp' failed: expected one chirp, got %d", len(chirps))
 	}
+	if chirps[0].Body != "wow a chirp!" || chirps[0].AuthorID != 1 {
+		t.Fatalf("Test 'CreateChirp' failed: got %+v", chirps[0])
+	}
+}
+
+// concurrent writers must not overwrite each other's changes
+func TestConcurrentUpdates(t *testing.T) {
+	db, path := beforeEach(t)
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.CreateChirp("concurrent chirp", 1)
+			if err != nil {
+				t.Errorf("CreateChirp failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	chirps, err := db.GetChirps()
+	if err != nil {
+		t.Fatalf("GetChirps failed: %v", err)
+	}
+	if len(chirps) != 50 {
+		t.Fatalf("expected 50 chirps, got %d", len(chirps))
+	}
+	// writes go through a temporary file that is renamed into place
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil || len(entries) != 1 {
+		t.Fatalf("expected only the database file to remain, got %v (%v)", entries, err)
+	}
+}
+
+// changes made to a user by concurrent updates are all kept
+func TestUpdateUser(t *testing.T) {
+	db, _ := beforeEach(t)
+	policy := password.DefaultPolicy()
+	policy.BcryptCost = bcrypt.MinCost
+	alice, err := db.CreateUser("alice@example.com", "correct horse battery", policy)
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	_, err = db.CreateUser("bob@example.com", "correct horse battery", policy)
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, err := db.UpdateUser(alice.ID, func(u *database.User) error {
+				u.RevokeTokens(time.Now())
+				return nil
+			})
+			if err != nil {
+				t.Errorf("UpdateUser failed: %v", err)
+			}
+		}()
+	}
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := db.UpdateUser(alice.ID, func(u *database.User) error {
+			u.IsChirpyRed = true
+			return nil
+		})
+		if err != nil {
+			t.Errorf("UpdateUser failed: %v", err)
+		}
+	}()
+	wg.Wait()
+	user, err := db.GetUser(alice.ID)
+	if err != nil || user.TokenVersion != 20 || !user.IsChirpyRed {
+		t.Fatalf("expected every update to be kept, got %+v (%v)", user, err)
+	}
+
+	// a failed change saves nothing
+	errRefused := errors.New("refused")
+	_, err = db.UpdateUser(alice.ID, func(u *database.User) error {
+		u.IsChirpyRed = false
+		return errRefused
+	})
+	if !errors.Is(err, errRefused) {
+		t.Fatalf("expected the error from fn, got %v", err)
+	}
+	_, err = db.UpdateUser(alice.ID, func(u *database.User) error {
+		u.Email = "bob@example.com"
+		return nil
+	})
+	if !errors.Is(err, database.ErrEmailInUse) {
+		t.Fatalf("expected ErrEmailInUse, got %v", err)
+	}
+	user, err = db.GetUser(alice.ID)
+	if err != nil || !user.IsChirpyRed || user.Email != "alice@example.com" {
+		t.Fatalf("expected the user to be unchanged, got %+v (%v)", user, err)
+	}
+
+	// resets went to the old address, so a new email voids them
+	reset, err := db.CreatePasswordReset(alice.ID, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	_, err = db.UpdateUser(alice.ID, func(u *database.User) error {
+		u.Email = "alice@example.org"
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	_, err = db.UsePasswordReset(reset)
+	if !errors.Is(err, database.ErrPasswordResetInvalid) {
+		t.Fatalf("expected the reset to be voided, got %v", err)
+	}
+
+	// a user that is gone is not written back
+	_, err = db.UpdateUser(99, func(u *database.User) error { return nil })
+	if !errors.Is(err, database.ErrUserNotFound) {
+		t.Fatalf("expected ErrUserNotFound, got %v", err)
+	}
+	_, err = db.GetUser(99)
+	if !errors.Is(err, database.ErrUserNotFound) {
+		t.Fatalf("expected no user 99, got %v", err)
+	}
+}
+
+// emails are stored in lower case, and found whatever their case
+func TestUserEmailCase(t *testing.T) {
+	db, path := beforeEach(t)
+	policy := password.DefaultPolicy()
+	policy.BcryptCost = bcrypt.MinCost
+	alice, err := db.CreateUser("Alice@Example.com", "correct horse battery", policy)
+	if err != nil || alice.Email != "alice@example.com" {
+		t.Fatalf("expected a lower-case email, got %+v (%v)", alice, err)
+	}
+	_, err = db.CreateUser("ALICE@example.com", "correct horse battery", policy)
+	if !errors.Is(err, database.ErrEmailInUse) {
+		t.Fatalf("expected ErrEmailInUse, got %v", err)
+	}
+	found, err := db.GetUserByEmail("alice@EXAMPLE.com")
+	if err != nil || found.ID != alice.ID {
+		t.Fatalf("expected to find alice, got %+v (%v)", found, err)
+	}
+
+	// accounts from before normalisation keep working, and an exact match
+	// wins over one that differs in case
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read database: %v", err)
+	}
+	legacy := strings.Replace(string(data), `"email":"alice@example.com"`, `"email":"Alice@Example.com"`, 1)
+	err = os.WriteFile(path, []byte(legacy), 0600)
+	if err != nil {
+		t.Fatalf("failed to write database: %v", err)
+	}
+	found, err = db.GetUserByEmail("alice@example.com")
+	if err != nil || found.ID != alice.ID {
+		t.Fatalf("expected to find the legacy account, got %+v (%v)", found, err)
+	}
+	bob, err := db.CreateUser("bob@example.com", "correct horse battery", policy)
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	_, err = db.UpdateUser(bob.ID, func(u *database.User) error {
+		u.Email = "alice@example.com"
+		return nil
+	})
+	if !errors.Is(err, database.ErrEmailInUse) {
+		t.Fatalf("expected ErrEmailInUse, got %v", err)
+	}
+}
+
+func TestRefreshTokenRotation(t *testing.T) {
+	db, _ := beforeEach(t)
+	first, err := db.CreateRefreshToken(1, database.Client{Device: "laptop"}, database.Grant{}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken failed: %v", err)
+	}
+	second, rt, err := db.RotateRefreshToken(first, "", database.Client{Device: "ignored"}, time.Hour)
+	if err != nil {
+		t.Fatalf("RotateRefreshToken failed: %v", err)
+	}
+	if second == first || rt.UserID != 1 || rt.Device != "laptop" {
+		t.Fatalf("unexpected rotation: %q %+v", second, rt)
+	}
+	// tokens are only accepted from the client they were issued to
+	_, _, err = db.RotateRefreshToken(second, "some-client", database.Client{}, time.Hour)
+	if !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Fatalf("expected ErrRefreshTokenInvalid for another client, got %v", err)
+	}
+
+	// presenting the replaced token again revokes the whole family
+	_, _, err = db.RotateRefreshToken(first, "", database.Client{}, time.Hour)
+	if !errors.Is(err, database.ErrRefreshTokenReused) {
+		t.Fatalf("expected ErrRefreshTokenReused, got %v", err)
+	}
+	_, _, err = db.RotateRefreshToken(second, "", database.Client{}, time.Hour)
+	if !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Fatalf("expected the family to be revoked, got %v", err)
+	}
+	sessions, err := db.GetSessions(1)
+	if err != nil || len(sessions) != 0 {
+		t.Fatalf("expected no sessions left, got %v (%v)", sessions, err)
+	}
+}
+
+// only one of several concurrent refreshes with the same token may succeed
+func TestConcurrentRefreshTokenRotation(t *testing.T) {
+	db, _ := beforeEach(t)
+	token, err := db.CreateRefreshToken(1, database.Client{}, database.Grant{}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	rotated := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := db.RotateRefreshToken(token, "", database.Client{}, time.Hour)
+			if err == nil {
+				mu.Lock()
+				rotated++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if rotated != 1 {
+		t.Fatalf("expected exactly one rotation, got %d", rotated)
+	}
+}
+
+func TestRefreshTokenExpiry(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	token, err := db.CreateRefreshToken(1, database.Client{}, database.Grant{}, time.Hour)
+	if err != nil {
+		t.Fatalf("CreateRefreshToken failed: %v", err)
+	}
+	now = now.Add(time.Hour + time.Second)
+	_, _, err = db.RotateRefreshToken(token, "", database.Client{}, time.Hour)
+	if !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Fatalf("expected an expired token to be rejected, got %v", err)
+	}
+	err = db.DeleteExpiredRefreshTokens(now)
+	if err != nil {
+		t.Fatalf("DeleteExpiredRefreshTokens failed: %v", err)
+	}
+	_, err = db.GetRefreshToken(token)
+	if !errors.Is(err, database.ErrRefreshTokenInvalid) {
+		t.Fatalf("expected the token to be gone, got %v", err)
+	}
+}
+
+// using a personal token records when, without losing concurrent writes
+func TestUsePersonalToken(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	var mu sync.Mutex
+	clock := func() time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		return now
+	}
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), clock)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	token, _, err := db.CreatePersonalToken(1, "bot", []string{"chirps:write"}, nil)
+	if err != nil {
+		t.Fatalf("CreatePersonalToken failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			_, err := db.UsePersonalToken(token)
+			if err != nil {
+				t.Errorf("UsePersonalToken failed: %v", err)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			_, err := db.CreateChirp("posted by a bot", 1)
+			if err != nil {
+				t.Errorf("CreateChirp failed: %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+	chirps, err := db.GetChirps()
+	if err != nil || len(chirps) != 20 {
+		t.Fatalf("expected 20 chirps, got %d (%v)", len(chirps), err)
+	}
+	tokens, err := db.GetPersonalTokens(1)
+	if err != nil || len(tokens) != 1 || tokens[0].LastUsedAt == nil || !tokens[0].LastUsedAt.Equal(now) {
+		t.Fatalf("expected the last-used time to be recorded, got %+v (%v)", tokens, err)
+	}
+
+	mu.Lock()
+	now = now.Add(time.Hour)
+	mu.Unlock()
+	pt, err := db.UsePersonalToken(token)
+	if err != nil || !pt.LastUsedAt.Equal(now) {
+		t.Fatalf("expected the last-used time to move, got %+v (%v)", pt, err)
+	}
+	_, err = db.UsePersonalToken("chirpy_pat_not-a-token")
+	if !errors.Is(err, database.ErrPersonalTokenInvalid) {
+		t.Fatalf("expected ErrPersonalTokenInvalid, got %v", err)
+	}
+}
+
+func TestTokenRevoked(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 500, time.UTC)
+	u := database.User{}
+	before := u.TokenVersion
+	u.RevokeTokens(now)
+	// tokens issued earlier in the second of the revocation are revoked,
+	// and those issued later in it are not
+	if !u.TokenRevoked(now, before) {
+		t.Fatal("expected a token issued before the revocation to be revoked")
+	}
+	if u.TokenRevoked(now, u.TokenVersion) {
+		t.Fatal("expected a token issued after the revocation to be accepted")
+	}
+
+	// tokens from before token versions are judged by time alone
+	legacy := database.User{TokensRevokedAt: now}
+	if !legacy.TokenRevoked(now.Add(-time.Second), 0) {
+		t.Fatal("expected an older legacy token to be revoked")
+	}
+	if legacy.TokenRevoked(now.Add(time.Second), 0) {
+		t.Fatal("expected a newer legacy token to be accepted")
+	}
+}
+
+func TestPasswordResetSingleUse(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	first, err := db.CreatePasswordReset(1, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	// a new token replaces the old one
+	token, err := db.CreatePasswordReset(1, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	_, err = db.UsePasswordReset(first)
+	if !errors.Is(err, database.ErrPasswordResetInvalid) {
+		t.Fatalf("expected the first token to be replaced, got %v", err)
+	}
+
+	// of several concurrent confirms, only one redeems the token
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	used := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pr, err := db.UsePasswordReset(token)
+			if err == nil {
+				if pr.UserID != 1 || pr.Email != "alice@example.com" {
+					t.Errorf("unexpected reset: %+v", pr)
+				}
+				mu.Lock()
+				used++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if used != 1 {
+		t.Fatalf("expected the token to be used once, got %d", used)
+	}
+
+	expired, err := db.CreatePasswordReset(1, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	now = now.Add(time.Hour + time.Second)
+	_, err = db.UsePasswordReset(expired)
+	if !errors.Is(err, database.ErrPasswordResetInvalid) {
+		t.Fatalf("expected an expired token to be rejected, got %v", err)
+	}
+
+	pending, err := db.CreatePasswordReset(1, "alice@example.com", time.Hour)
+	if err != nil {
+		t.Fatalf("CreatePasswordReset failed: %v", err)
+	}
+	err = db.DeletePasswordResets(1)
+	if err != nil {
+		t.Fatalf("DeletePasswordResets failed: %v", err)
+	}
+	_, err = db.UsePasswordReset(pending)
+	if !errors.Is(err, database.ErrPasswordResetInvalid) {
+		t.Fatalf("expected the token to be deleted, got %v", err)
+	}
+}
+
+// an authorization code is exchanged once; presenting it again revokes the
+// session it started
+func TestExchangeOAuthCode(t *testing.T) {
+	db, _ := beforeEach(t)
+	policy := password.DefaultPolicy()
+	policy.BcryptCost = bcrypt.MinCost
+	user, err := db.CreateUser("alice@example.com", "correct horse battery", policy)
+	if err != nil {
+		t.Fatalf("CreateUser failed: %v", err)
+	}
+	grant := database.Grant{ClientID: "client", Scopes: []string{"profile:read"}}
+	accept := func(*database.OAuthCode) error { return nil }
+	code, err := db.CreateOAuthCode(user.ID, grant, "https://app.example.com/callback", "challenge", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateOAuthCode failed: %v", err)
+	}
+	_, _, err = db.ExchangeOAuthCode(code, "other-client", database.Client{}, time.Hour, accept)
+	if !errors.Is(err, database.ErrOAuthCodeInvalid) {
+		t.Fatalf("expected ErrOAuthCodeInvalid for another client, got %v", err)
+	}
+	_, _, err = db.ExchangeOAuthCode(code, "client", database.Client{}, time.Hour, accept)
+	if !errors.Is(err, database.ErrOAuthCodeReused) {
+		t.Fatalf("expected a failed exchange to use the code up, got %v", err)
+	}
+
+	code, err = db.CreateOAuthCode(user.ID, grant, "https://app.example.com/callback", "challenge", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateOAuthCode failed: %v", err)
+	}
+	_, oc, err := db.ExchangeOAuthCode(code, "client", database.Client{}, time.Hour, accept)
+	if err != nil {
+		t.Fatalf("ExchangeOAuthCode failed: %v", err)
+	}
+	active, err := db.SessionActive(user.ID, oc.FamilyID)
+	if err != nil || !active {
+		t.Fatalf("expected the session to be active, got %v (%v)", active, err)
+	}
+	_, _, err = db.ExchangeOAuthCode(code, "client", database.Client{}, time.Hour, accept)
+	if !errors.Is(err, database.ErrOAuthCodeReused) {
+		t.Fatalf("expected ErrOAuthCodeReused, got %v", err)
+	}
+	active, err = db.SessionActive(user.ID, oc.FamilyID)
+	if err != nil || active {
+		t.Fatalf("expected the session to be revoked, got %v (%v)", active, err)
+	}
+
+	// of several concurrent exchanges, only one redeems the code
+	code, err = db.CreateOAuthCode(user.ID, grant, "https://app.example.com/callback", "challenge", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateOAuthCode failed: %v", err)
+	}
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	exchanged := 0
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, _, err := db.ExchangeOAuthCode(code, "client", database.Client{}, time.Hour, accept)
+			if err == nil {
+				mu.Lock()
+				exchanged++
+				mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	if exchanged != 1 {
+		t.Fatalf("expected exactly one exchange, got %d", exchanged)
+	}
+
+	// codes issued before the user's tokens were revoked are rejected
+	code, err = db.CreateOAuthCode(user.ID, grant, "https://app.example.com/callback", "challenge", time.Minute)
+	if err != nil {
+		t.Fatalf("CreateOAuthCode failed: %v", err)
+	}
+	_, err = db.UpdateUser(user.ID, func(u *database.User) error {
+		u.RevokeTokens(time.Now())
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	_, _, err = db.ExchangeOAuthCode(code, "client", database.Client{}, time.Hour, accept)
+	if !errors.Is(err, database.ErrOAuthCodeInvalid) {
+		t.Fatalf("expected ErrOAuthCodeInvalid after a revocation, got %v", err)
+	}
+}
+
+// purging an account removes everything held about it
+func TestPurgeDeletedUsers(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	policy := password.DefaultPolicy()
+	policy.BcryptCost = bcrypt.MinCost
+	type held struct {
+		user   *database.User
+		export string
+		reset  string
+		code   string
+	}
+	create := func(email string) held {
+		u, err := db.CreateUser(email, "correct horse battery", policy)
+		if err != nil {
+			t.Fatalf("CreateUser failed: %v", err)
+		}
+		h := held{user: u}
+		_, err = db.CreateChirp("hello", u.ID)
+		if err == nil {
+			_, err = db.CreateRefreshToken(u.ID, database.Client{}, database.Grant{}, time.Hour)
+		}
+		if err == nil {
+			var e *database.Export
+			e, err = db.CreateExport(u.ID, time.Hour)
+			if e != nil {
+				h.export = e.ID
+			}
+		}
+		if err == nil {
+			h.reset, err = db.CreatePasswordReset(u.ID, email, time.Hour)
+		}
+		if err == nil {
+			_, _, err = db.CreatePersonalToken(u.ID, "bot", []string{"chirps:write"}, nil)
+		}
+		if err == nil {
+			h.code, err = db.CreateOAuthCode(u.ID, database.Grant{ClientID: "client"}, "https://app.example.com/callback", "challenge", time.Hour)
+		}
+		if err != nil {
+			t.Fatalf("failed to create records for %s: %v", email, err)
+		}
+		return h
+	}
+	alice, bob := create("alice@example.com"), create("bob@example.com")
+	if alice.user.ID == 0 {
+		t.Fatal("user ID 0 is kept for anonymised chirps")
+	}
+
+	deletedAt := now.Add(-time.Hour)
+	_, err = db.UpdateUser(alice.user.ID, func(u *database.User) error {
+		u.DeletedAt = &deletedAt
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("UpdateUser failed: %v", err)
+	}
+	n, exports, err := db.PurgeDeletedUsers(now.Add(-time.Hour*2), database.ChirpPolicyAnonymise)
+	if err != nil || n != 0 || len(exports) != 0 {
+		t.Fatalf("expected nothing to be purged within the grace period, got %d %v (%v)", n, exports, err)
+	}
+	n, exports, err = db.PurgeDeletedUsers(now, database.ChirpPolicyAnonymise)
+	if err != nil || n != 1 || len(exports) != 1 || exports[0].ID != alice.export {
+		t.Fatalf("expected alice to be purged, got %d %v (%v)", n, exports, err)
+	}
+
+	chirps, err := db.GetChirps()
+	if err != nil || len(chirps) != 2 {
+		t.Fatalf("expected both chirps to remain, got %v (%v)", chirps, err)
+	}
+	for _, c := range chirps {
+		if c.AuthorID != bob.user.ID && c.AuthorID != 0 {
+			t.Fatalf("expected alice's chirp to be anonymised, got %+v", c)
+		}
+	}
+	accept := func(*database.OAuthCode) error { return nil }
+	for _, h := range []held{alice, bob} {
+		gone := h.user.ID == alice.user.ID
+		_, err = db.GetUser(h.user.ID)
+		if (err != nil) != gone {
+			t.Fatalf("user %d: unexpected lookup result %v", h.user.ID, err)
+		}
+		sessions, err := db.GetSessions(h.user.ID)
+		if err != nil || (len(sessions) == 0) != gone {
+			t.Fatalf("user %d: unexpected sessions %v (%v)", h.user.ID, sessions, err)
+		}
+		tokens, err := db.GetPersonalTokens(h.user.ID)
+		if err != nil || (len(tokens) == 0) != gone {
+			t.Fatalf("user %d: unexpected personal tokens %v (%v)", h.user.ID, tokens, err)
+		}
+		_, err = db.GetExport(h.export)
+		if (err != nil) != gone {
+			t.Fatalf("user %d: unexpected export lookup result %v", h.user.ID, err)
+		}
+		_, err = db.UsePasswordReset(h.reset)
+		if (err != nil) != gone {
+			t.Fatalf("user %d: unexpected password reset result %v", h.user.ID, err)
+		}
+		_, _, err = db.ExchangeOAuthCode(h.code, "client", database.Client{}, time.Hour, accept)
+		if (err != nil) != gone {
+			t.Fatalf("user %d: unexpected code exchange result %v", h.user.ID, err)
+		}
+	}
+}
+
+// databases written before user_seq existed never hand out ID 0
+func TestCreateUserLegacySequence(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "database.json")
+	err := os.WriteFile(path, []byte(`{"chirps":{},"users":{}}`), 0600)
+	if err != nil {
+		t.Fatalf("failed to write database: %v", err)
+	}
+	db, err := database.NewDB(path, nil)
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	policy := password.DefaultPolicy()
+	policy.BcryptCost = bcrypt.MinCost
+	u, err := db.CreateUser("alice@example.com", "correct horse battery", policy)
+	if err != nil || u.ID != 1 {
+		t.Fatalf("expected the first user to get ID 1, got %+v (%v)", u, err)
+	}
+}
+
+func TestExportLifecycle(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	db, err := database.NewDB(filepath.Join(t.TempDir(), "database.json"), func() time.Time { return now })
+	if err != nil {
+		t.Fatalf("NewDB failed: %v", err)
+	}
+	export, err := db.CreateExport(1, time.Hour)
+	if err != nil || export.Status != database.ExportPending {
+		t.Fatalf("expected a pending export, got %+v (%v)", export, err)
+	}
+	// one export at a time, unless the pending one was abandoned
+	_, err = db.CreateExport(1, time.Hour)
+	if !errors.Is(err, database.ErrExportPending) {
+		t.Fatalf("expected ErrExportPending, got %v", err)
+	}
+	_, err = db.CreateExport(2, time.Hour)
+	if err != nil {
+		t.Fatalf("expected other users to be unaffected, got %v", err)
+	}
+	now = now.Add(time.Hour)
+	abandoned, err := db.CreateExport(1, time.Hour)
+	if err != nil {
+		t.Fatalf("expected a stale pending export not to count, got %v", err)
+	}
+	abandoned.Status = database.ExportFailed
+	_, err = db.UpdateExport(abandoned)
+	if err != nil {
+		t.Fatalf("UpdateExport failed: %v", err)
+	}
+	expires := now.Add(time.Hour)
+	export.Status = database.ExportReady
+	export.ExpiresAt = &expires
+	_, err = db.UpdateExport(export)
+	if err != nil {
+		t.Fatalf("UpdateExport failed: %v", err)
+	}
+	got, err := db.GetExport(export.ID)
+	if err != nil || got.Status != database.ExportReady || got.UserID != 1 {
+		t.Fatalf("expected the export to be ready, got %+v (%v)", got, err)
+	}
+
+	expired, err := db.DeleteExpiredExports(now)
+	if err != nil || len(expired) != 0 {
+		t.Fatalf("expected nothing to expire yet, got %v (%v)", expired, err)
+	}
+	expired, err = db.DeleteExpiredExports(expires.Add(time.Second))
+	if err != nil || len(expired) != 1 || expired[0].ID != export.ID {
+		t.Fatalf("expected the export to expire, got %v (%v)", expired, err)
+	}
+	_, err = db.GetExport(export.ID)
+	if err == nil {
+		t.Fatal("expected the export to be gone")
+	}
 }
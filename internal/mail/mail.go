@@ -0,0 +1,145 @@
+package mail
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	netmail "net/mail"
+	"net/smtp"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+var ErrInvalidAddress = errors.New("invalid email address")
+
+// Message is a plain-text email.
+type Message struct {
+	To      string
+	Subject string
+	Body    string
+}
+
+// Mailer delivers messages. SMTPMailer is used in production; LogMailer and
+// FileMailer let development setups read messages without a mail server.
+type Mailer interface {
+	Send(msg Message) error
+}
+
+// ValidAddress reports whether s is a bare email address such as
+// "someone@example.com", without a display name or angle brackets.
+func ValidAddress(s string) bool {
+	addr, err := netmail.ParseAddress(s)
+	return err == nil && addr.Name == "" && addr.Address == s
+}
+
+// Normalize returns the form an address is stored and compared in, so
+// that "Alice@Example.com" and "alice@example.com" are the same account.
+func Normalize(address string) string {
+	return strings.ToLower(strings.TrimSpace(address))
+}
+
+// format renders msg as an RFC 5322 message from the given sender.
+func (msg Message) format(from string) ([]byte, error) {
+	if !ValidAddress(msg.To) {
+		return nil, ErrInvalidAddress
+	}
+	if strings.ContainsAny(msg.Subject, "\r\n") {
+		return nil, errors.New("subject must be a single line")
+	}
+	b := bytes.Buffer{}
+	fmt.Fprintf(&b, "From: %s\r\n", from)
+	fmt.Fprintf(&b, "To: %s\r\n", msg.To)
+	fmt.Fprintf(&b, "Subject: %s\r\n", msg.Subject)
+	fmt.Fprintf(&b, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	b.WriteString("MIME-Version: 1.0\r\n")
+	b.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	b.WriteString("\r\n")
+	b.WriteString(strings.ReplaceAll(strings.ReplaceAll(msg.Body, "\r\n", "\n"), "\n", "\r\n"))
+	return b.Bytes(), nil
+}
+
+// SMTPMailer sends messages through an SMTP server, upgrading to TLS when
+// the server offers STARTTLS.
+type SMTPMailer struct {
+	Addr string
+	From string
+	Auth smtp.Auth
+}
+
+// NewSMTPMailer returns a mailer for the server at addr ("host:port"). Auth
+// is only attempted when username is set.
+func NewSMTPMailer(addr string, from string, username string, password string) (*SMTPMailer, error) {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if !ValidAddress(from) {
+		return nil, ErrInvalidAddress
+	}
+	m := SMTPMailer{Addr: addr, From: from}
+	if username != "" {
+		m.Auth = smtp.PlainAuth("", username, password, host)
+	}
+	return &m, nil
+}
+
+func (m *SMTPMailer) Send(msg Message) error {
+	data, err := msg.format(m.From)
+	if err != nil {
+		return err
+	}
+	return smtp.SendMail(m.Addr, m.Auth, m.From, []string{msg.To}, data)
+}
+
+// LogMailer writes every message to a log instead of sending it.
+type LogMailer struct {
+	logger *log.Logger
+	from   string
+}
+
+func NewLogMailer(w io.Writer, from string) *LogMailer {
+	return &LogMailer{
+		logger: log.New(w, "mail: ", log.LstdFlags),
+		from:   from,
+	}
+}
+
+func (m *LogMailer) Send(msg Message) error {
+	data, err := msg.format(m.from)
+	if err != nil {
+		return err
+	}
+	m.logger.Printf("\n%s\n", data)
+	return nil
+}
+
+// FileMailer writes every message to its own .eml file in Dir.
+type FileMailer struct {
+	Dir  string
+	From string
+}
+
+func (m *FileMailer) Send(msg Message) error {
+	data, err := msg.format(m.From)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(m.Dir, 0700)
+	if err != nil {
+		return err
+	}
+	suffix := make([]byte, 4)
+	_, err = rand.Read(suffix)
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%s-%s.eml", time.Now().UTC().Format("20060102T150405"), hex.EncodeToString(suffix))
+	return os.WriteFile(filepath.Join(m.Dir, name), data, 0600)
+}
@@ -0,0 +1,154 @@
+package mail_test
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/am1macdonald/chirpy/internal/mail"
+)
+
+// smtpServer is a minimal in-process SMTP server that accepts every message
+// and hands its envelope and data to the test.
+type smtpServer struct {
+	ln       net.Listener
+	messages chan received
+}
+
+type received struct {
+	from string
+	to   []string
+	data string
+}
+
+func newSMTPServer(t *testing.T) *smtpServer {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &smtpServer{ln: ln, messages: make(chan received, 1)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.session(conn)
+	}
+}
+
+func (s *smtpServer) session(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	msg := received{}
+	tp.PrintfLine("220 localhost ESMTP test")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		verb := strings.ToUpper(strings.SplitN(line, " ", 2)[0])
+		switch verb {
+		case "EHLO", "HELO":
+			tp.PrintfLine("250 localhost")
+		case "MAIL":
+			msg.from = strings.Trim(strings.TrimPrefix(line[5:], "FROM:"), "<>")
+			tp.PrintfLine("250 OK")
+		case "RCPT":
+			msg.to = append(msg.to, strings.Trim(strings.TrimPrefix(line[5:], "TO:"), "<>"))
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(data)
+			tp.PrintfLine("250 OK")
+			s.messages <- msg
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 not implemented")
+		}
+	}
+}
+
+func TestSMTPMailer(t *testing.T) {
+	s := newSMTPServer(t)
+	m, err := mail.NewSMTPMailer(s.ln.Addr().String(), "chirpy@example.com", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = m.Send(mail.Message{
+		To:      "someone@example.com",
+		Subject: "Hello",
+		Body:    "first line\nsecond line",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := <-s.messages
+	if got.from != "chirpy@example.com" || len(got.to) != 1 || got.to[0] != "someone@example.com" {
+		t.Fatalf("unexpected envelope %q -> %q", got.from, got.to)
+	}
+	for _, want := range []string{"To: someone@example.com\n", "Subject: Hello\n", "first line\nsecond line"} {
+		if !strings.Contains(got.data, want) {
+			t.Fatalf("expected message to contain %q, got:\n%s", want, got.data)
+		}
+	}
+}
+
+// header injection through the recipient or subject is refused
+func TestRejectsInvalidHeaders(t *testing.T) {
+	m := mail.NewLogMailer(&bytes.Buffer{}, "chirpy@example.com")
+	bad := []mail.Message{
+		{To: "someone@example.com\r\nBcc: other@example.com", Subject: "Hello"},
+		{To: "Someone <someone@example.com>", Subject: "Hello"},
+		{To: "someone@example.com", Subject: "Hello\r\nBcc: other@example.com"},
+	}
+	for _, msg := range bad {
+		if err := m.Send(msg); err == nil {
+			t.Fatalf("expected %+v to be rejected", msg)
+		}
+	}
+}
+
+func TestFileMailer(t *testing.T) {
+	dir := t.TempDir()
+	m := &mail.FileMailer{Dir: dir, From: "chirpy@example.com"}
+	for i := 0; i < 2; i++ {
+		err := m.Send(mail.Message{To: "someone@example.com", Subject: fmt.Sprintf("Message %d", i), Body: "hi"})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 {
+		t.Fatalf("expected 2 messages, got %d", len(files))
+	}
+	f, err := os.Open(files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	first, err := bufio.NewReader(f).ReadString('\n')
+	if err != nil || first != "From: chirpy@example.com\r\n" {
+		t.Fatalf("unexpected first line %q", first)
+	}
+}
@@ -0,0 +1,142 @@
+// Package metrics holds the Prometheus collectors Chirpy exports on
+// /metrics. Collectors are registered on Registry rather than the default
+// registry, so only Chirpy's own metrics are exposed.
+package metrics
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/collectors"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+const namespace = "chirpy"
+
+// Login results counted by Logins.
+const (
+	LoginSuccess     = "success"
+	LoginFailure     = "failure"
+	LoginThrottled   = "throttled"
+	LoginMFARequired = "mfa_required"
+	LoginMFAFailure  = "mfa_failure"
+)
+
+// RouteNone labels requests that matched no route.
+const RouteNone = "none"
+
+var (
+	Registry = prometheus.NewRegistry()
+
+	HTTPRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "http_requests_total",
+		Help:      "HTTP requests by route pattern, method and status code.",
+	}, []string{"route", "method", "code"})
+
+	HTTPDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_request_duration_seconds",
+		Help:      "Time taken to serve HTTP requests.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"route", "method", "code"})
+
+	HTTPResponseSize = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "http_response_size_bytes",
+		Help:      "Size of HTTP response bodies.",
+		Buckets:   prometheus.ExponentialBuckets(64, 4, 8),
+	}, []string{"route", "method", "code"})
+
+	DBDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: namespace,
+		Name:      "db_operation_duration_seconds",
+		Help:      "Time taken to read and write the database file.",
+		Buckets:   []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1},
+	}, []string{"operation"})
+
+	Logins = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: namespace,
+		Name:      "logins_total",
+		Help:      "Login attempts by result.",
+	}, []string{"result"})
+)
+
+func init() {
+	Registry.MustRegister(
+		collectors.NewGoCollector(),
+		collectors.NewProcessCollector(collectors.ProcessCollectorOpts{}),
+		HTTPRequests,
+		HTTPDuration,
+		HTTPResponseSize,
+		DBDuration,
+		Logins,
+	)
+}
+
+// Handler serves the registered metrics in the Prometheus text format.
+func Handler() http.Handler {
+	return promhttp.HandlerFor(Registry, promhttp.HandlerOpts{})
+}
+
+// ObserveDB records how long a database operation started at start took,
+// e.g. `defer metrics.ObserveDB("load", time.Now())`.
+func ObserveDB(operation string, start time.Time) {
+	DBDuration.WithLabelValues(operation).Observe(time.Since(start).Seconds())
+}
+
+// Login counts a login attempt with the given result.
+func Login(result string) {
+	Logins.WithLabelValues(result).Inc()
+}
+
+// responseWriter remembers the status code and body size of a response.
+type responseWriter struct {
+	http.ResponseWriter
+	code  int
+	bytes int
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.code == 0 {
+		w.code = code
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *responseWriter) Write(b []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+	return n, err
+}
+
+func (w *responseWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// Instrument records every request next serves under the route pattern
+// route returns for it. Labelling by pattern rather than path keeps IDs
+// out of the label values.
+func Instrument(route func(r *http.Request) string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		pattern := route(r)
+		if pattern == "" {
+			pattern = RouteNone
+		}
+		rw := &responseWriter{ResponseWriter: w}
+		next.ServeHTTP(rw, r)
+		if rw.code == 0 {
+			rw.code = http.StatusOK
+		}
+		code := strconv.Itoa(rw.code)
+		HTTPRequests.WithLabelValues(pattern, r.Method, code).Inc()
+		HTTPDuration.WithLabelValues(pattern, r.Method, code).Observe(time.Since(start).Seconds())
+		HTTPResponseSize.WithLabelValues(pattern, r.Method, code).Observe(float64(rw.bytes))
+	})
+}
@@ -0,0 +1,42 @@
+package metrics_test
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestInstrument(t *testing.T) {
+	handler := metrics.Instrument(func(r *http.Request) string {
+		if r.URL.Path == "/chirps/1" {
+			return "GET /chirps/{id}"
+		}
+		return ""
+	}, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/chirps/1" {
+			http.NotFound(w, r)
+			return
+		}
+		w.Write([]byte("chirp"))
+	}))
+	for _, path := range []string{"/chirps/1", "/chirps/1", "/missing"} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+	}
+	tests := []struct {
+		route string
+		code  string
+		count float64
+	}{
+		{"GET /chirps/{id}", "200", 2},
+		{metrics.RouteNone, "404", 1},
+	}
+	for _, tt := range tests {
+		got := testutil.ToFloat64(metrics.HTTPRequests.WithLabelValues(tt.route, "GET", tt.code))
+		if got != tt.count {
+			t.Errorf("expected %v requests for %s %s, got %v", tt.count, tt.route, tt.code, got)
+		}
+	}
+}
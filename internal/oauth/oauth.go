@@ -0,0 +1,114 @@
+package oauth
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/url"
+	"strings"
+)
+
+// Error codes from RFC 6749 sections 4.1.2.1 and 5.2.
+const (
+	ErrInvalidRequest       string = "invalid_request"
+	ErrInvalidClient        string = "invalid_client"
+	ErrInvalidGrant         string = "invalid_grant"
+	ErrInvalidScope         string = "invalid_scope"
+	ErrUnauthorizedClient   string = "unauthorized_client"
+	ErrUnsupportedGrantType string = "unsupported_grant_type"
+	ErrUnsupportedResponse  string = "unsupported_response_type"
+	ErrAccessDenied         string = "access_denied"
+)
+
+// MethodS256 is the only PKCE method accepted; "plain" offers no protection
+// against an intercepted code.
+const MethodS256 string = "S256"
+
+// Challenge derives the S256 code challenge of a code verifier.
+func Challenge(verifier string) string {
+	sum := sha256.Sum256([]byte(verifier))
+	return base64.RawURLEncoding.EncodeToString(sum[:])
+}
+
+// VerifyPKCE checks a code verifier against the challenge sent with the
+// authorization request, RFC 7636 section 4.6.
+func VerifyPKCE(challenge string, verifier string) bool {
+	if !validVerifier(verifier) {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(Challenge(verifier)), []byte(challenge)) == 1
+}
+
+// validVerifier applies RFC 7636 section 4.1: 43 to 128 unreserved characters.
+func validVerifier(v string) bool {
+	if len(v) < 43 || len(v) > 128 {
+		return false
+	}
+	for _, c := range v {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '-', c == '.', c == '_', c == '~':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// ValidChallenge reports whether s can be an S256 code challenge.
+func ValidChallenge(s string) bool {
+	b, err := base64.RawURLEncoding.DecodeString(s)
+	return err == nil && len(b) == sha256.Size
+}
+
+// ParseScope splits a space-separated scope parameter, dropping duplicates.
+func ParseScope(s string) []string {
+	scopes := []string{}
+	seen := map[string]bool{}
+	for _, scope := range strings.Fields(s) {
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes
+}
+
+// ValidateRedirectURI accepts absolute https URIs without a fragment, and
+// http ones for local development only.
+func ValidateRedirectURI(s string) error {
+	u, err := url.Parse(s)
+	if err != nil || !u.IsAbs() || u.Host == "" {
+		return errors.New("redirect URI must be an absolute URL")
+	}
+	if u.Fragment != "" {
+		return errors.New("redirect URI must not have a fragment")
+	}
+	switch u.Scheme {
+	case "https":
+		return nil
+	case "http":
+		host := u.Hostname()
+		if host == "localhost" || host == "127.0.0.1" || host == "::1" {
+			return nil
+		}
+	}
+	return errors.New("redirect URI must use https")
+}
+
+// RedirectWith adds parameters to a registered redirect URI.
+func RedirectWith(redirectURI string, params url.Values) string {
+	u, err := url.Parse(redirectURI)
+	if err != nil {
+		return redirectURI
+	}
+	q := u.Query()
+	for k, vs := range params {
+		for _, v := range vs {
+			q.Add(k, v)
+		}
+	}
+	u.RawQuery = q.Encode()
+	return u.String()
+}
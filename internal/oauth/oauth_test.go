@@ -0,0 +1,63 @@
+package oauth_test
+
+import (
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/am1macdonald/chirpy/internal/oauth"
+)
+
+// the example of RFC 7636 appendix B
+func TestPKCE(t *testing.T) {
+	verifier := "dBjftJeZ4CVP-mB92K27uhbUJU1p1r_wW1gFWFOEjXk"
+	challenge := "E9Melhoa2OwvFrEMTJguCHaoeK1t8URWbuGJSstw-cM"
+	if got := oauth.Challenge(verifier); got != challenge {
+		t.Fatalf("expected challenge %s, got %s", challenge, got)
+	}
+	if !oauth.ValidChallenge(challenge) {
+		t.Fatal("expected challenge to be well-formed")
+	}
+	if !oauth.VerifyPKCE(challenge, verifier) {
+		t.Fatal("expected verifier to match")
+	}
+	if oauth.VerifyPKCE(challenge, strings.Replace(verifier, "d", "e", 1)) {
+		t.Fatal("expected other verifier to be rejected")
+	}
+	if oauth.VerifyPKCE(oauth.Challenge("short"), "short") {
+		t.Fatal("expected verifier shorter than 43 characters to be rejected")
+	}
+}
+
+func TestValidateRedirectURI(t *testing.T) {
+	tests := []struct {
+		uri string
+		ok  bool
+	}{
+		{"https://app.example.com/callback", true},
+		{"http://localhost:3000/callback", true},
+		{"http://127.0.0.1/callback", true},
+		{"http://app.example.com/callback", false},
+		{"https://app.example.com/callback#frag", false},
+		{"/callback", false},
+		{"javascript:alert(1)", false},
+	}
+	for _, tt := range tests {
+		err := oauth.ValidateRedirectURI(tt.uri)
+		if (err == nil) != tt.ok {
+			t.Fatalf("%s: expected ok %v, got %v", tt.uri, tt.ok, err)
+		}
+	}
+}
+
+func TestRedirectWith(t *testing.T) {
+	got := oauth.RedirectWith("https://app.example.com/cb?keep=1", url.Values{"code": {"abc"}, "state": {"x y"}})
+	u, err := url.Parse(got)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := u.Query()
+	if q.Get("keep") != "1" || q.Get("code") != "abc" || q.Get("state") != "x y" {
+		t.Fatalf("unexpected redirect %s", got)
+	}
+}
@@ -0,0 +1,186 @@
+package password
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	Bcrypt   string = "bcrypt"
+	Argon2id string = "argon2id"
+)
+
+// MaxLength is the longest password accepted, in bytes: bcrypt cannot hash
+// longer ones, and a policy may move to bcrypt later.
+const MaxLength = 72
+
+var (
+	ErrTooShort = errors.New("password is too short")
+	ErrTooLong  = errors.New("password is too long")
+	ErrCommon   = errors.New("password is too common, choose another")
+)
+
+//go:embed common.txt
+var commonPasswords string
+
+// Argon2Params are the cost parameters of an argon2id hash.
+type Argon2Params struct {
+	// Memory is in KiB
+	Memory      uint32
+	Iterations  uint32
+	Parallelism uint8
+	SaltLength  uint32
+	KeyLength   uint32
+}
+
+// Policy decides how passwords are hashed and which passwords are accepted.
+type Policy struct {
+	Algorithm  string
+	BcryptCost int
+	Argon2     Argon2Params
+	MinLength  int
+	blocklist  map[string]bool
+}
+
+func DefaultPolicy() *Policy {
+	p := Policy{
+		Algorithm:  Bcrypt,
+		BcryptCost: 12,
+		Argon2: Argon2Params{
+			Memory:      64 * 1024,
+			Iterations:  3,
+			Parallelism: 2,
+			SaltLength:  16,
+			KeyLength:   32,
+		},
+		MinLength: 8,
+		blocklist: map[string]bool{},
+	}
+	p.addBlocklist(bufio.NewScanner(strings.NewReader(commonPasswords)))
+	return &p
+}
+
+// LoadBlocklist adds the passwords in a file, one per line, to the list of
+// rejected passwords, e.g. a local copy of a breached-password list.
+func (p *Policy) LoadBlocklist(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	return p.addBlocklist(bufio.NewScanner(f))
+}
+
+func (p *Policy) addBlocklist(sc *bufio.Scanner) error {
+	for sc.Scan() {
+		line := strings.TrimSpace(sc.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			p.blocklist[strings.ToLower(line)] = true
+		}
+	}
+	return sc.Err()
+}
+
+// Validate rejects passwords that are too short, too long or too common.
+func (p *Policy) Validate(plaintext string) error {
+	if len([]rune(plaintext)) < p.MinLength {
+		return fmt.Errorf("%w: use at least %d characters", ErrTooShort, p.MinLength)
+	}
+	if len(plaintext) > MaxLength {
+		return fmt.Errorf("%w: use at most %d bytes", ErrTooLong, MaxLength)
+	}
+	if p.blocklist[strings.ToLower(plaintext)] {
+		return ErrCommon
+	}
+	return nil
+}
+
+// Hash hashes a password with the policy's current algorithm and parameters.
+func (p *Policy) Hash(plaintext string) (string, error) {
+	if p.Algorithm == Argon2id {
+		salt := make([]byte, p.Argon2.SaltLength)
+		_, err := rand.Read(salt)
+		if err != nil {
+			return "", err
+		}
+		return encodeArgon2(p.Argon2, salt, argon2Key(p.Argon2, plaintext, salt)), nil
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(plaintext), p.BcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// NeedsRehash reports whether a hash was made with another algorithm or
+// other parameters than the policy's, and should be replaced on next login.
+func (p *Policy) NeedsRehash(hash string) bool {
+	if params, _, _, err := decodeArgon2(hash); err == nil {
+		return p.Algorithm != Argon2id || params != p.Argon2
+	}
+	cost, err := bcrypt.Cost([]byte(hash))
+	if err != nil {
+		return true
+	}
+	return p.Algorithm != Bcrypt || cost != p.BcryptCost
+}
+
+// Verify checks a password against a bcrypt or argon2id hash.
+func Verify(hash string, plaintext string) bool {
+	if params, salt, key, err := decodeArgon2(hash); err == nil {
+		return subtle.ConstantTimeCompare(key, argon2Key(params, plaintext, salt)) == 1
+	}
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(plaintext)) == nil
+}
+
+func argon2Key(params Argon2Params, plaintext string, salt []byte) []byte {
+	return argon2.IDKey([]byte(plaintext), salt, params.Iterations, params.Memory, params.Parallelism, params.KeyLength)
+}
+
+// encodeArgon2 uses the PHC string format shared by other argon2 libraries:
+// $argon2id$v=19$m=65536,t=3,p=2$<salt>$<key>
+func encodeArgon2(params Argon2Params, salt []byte, key []byte) string {
+	enc := base64.RawStdEncoding
+	return fmt.Sprintf("$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s", argon2.Version,
+		params.Memory, params.Iterations, params.Parallelism,
+		enc.EncodeToString(salt), enc.EncodeToString(key))
+}
+
+func decodeArgon2(hash string) (Argon2Params, []byte, []byte, error) {
+	params := Argon2Params{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != Argon2id {
+		return params, nil, nil, errors.New("not an argon2id hash")
+	}
+	var version int
+	_, err := fmt.Sscanf(parts[2], "v=%d", &version)
+	if err != nil || version != argon2.Version {
+		return params, nil, nil, errors.New("unsupported argon2 version")
+	}
+	_, err = fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.Memory, &params.Iterations, &params.Parallelism)
+	if err != nil {
+		return params, nil, nil, err
+	}
+	enc := base64.RawStdEncoding
+	salt, err := enc.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	key, err := enc.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, err
+	}
+	params.SaltLength = uint32(len(salt))
+	params.KeyLength = uint32(len(key))
+	return params, salt, key, nil
+}
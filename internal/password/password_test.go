@@ -0,0 +1,105 @@
+package password_test
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/am1macdonald/chirpy/internal/password"
+)
+
+// cheap parameters keep the tests fast
+func testPolicy(algorithm string) *password.Policy {
+	p := password.DefaultPolicy()
+	p.Algorithm = algorithm
+	p.BcryptCost = 4
+	p.Argon2.Memory = 1024
+	p.Argon2.Iterations = 1
+	return p
+}
+
+func TestHashAndVerify(t *testing.T) {
+	for _, algorithm := range []string{password.Bcrypt, password.Argon2id} {
+		t.Run(algorithm, func(t *testing.T) {
+			p := testPolicy(algorithm)
+			hash, err := p.Hash("correct horse battery staple")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !password.Verify(hash, "correct horse battery staple") {
+				t.Fatal("expected password to verify")
+			}
+			if password.Verify(hash, "wrong horse battery staple") {
+				t.Fatal("expected wrong password to fail")
+			}
+			if p.NeedsRehash(hash) {
+				t.Fatal("expected a fresh hash not to need rehashing")
+			}
+		})
+	}
+}
+
+// hashes made under an older policy are flagged for upgrade
+func TestNeedsRehash(t *testing.T) {
+	old := testPolicy(password.Bcrypt)
+	hash, err := old.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	stronger := testPolicy(password.Bcrypt)
+	stronger.BcryptCost = 5
+	if !stronger.NeedsRehash(hash) {
+		t.Fatal("expected a lower bcrypt cost to need rehashing")
+	}
+	if !testPolicy(password.Argon2id).NeedsRehash(hash) {
+		t.Fatal("expected a bcrypt hash to need rehashing under argon2id")
+	}
+
+	argon := testPolicy(password.Argon2id)
+	hash, err = argon.Hash("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	argon.Argon2.Iterations = 2
+	if !argon.NeedsRehash(hash) {
+		t.Fatal("expected changed argon2 parameters to need rehashing")
+	}
+}
+
+func TestValidate(t *testing.T) {
+	p := testPolicy(password.Bcrypt)
+	tests := []struct {
+		password string
+		err      error
+	}{
+		{"short", password.ErrTooShort},
+		{"password123", password.ErrCommon},
+		{"PASSWORD123", password.ErrCommon},
+		{"correct horse battery staple", nil},
+		{strings.Repeat("x", password.MaxLength), nil},
+		{strings.Repeat("x", password.MaxLength+1), password.ErrTooLong},
+		// the limit is in bytes, which bcrypt counts
+		{strings.Repeat("é", password.MaxLength/2+1), password.ErrTooLong},
+	}
+	for _, tt := range tests {
+		err := p.Validate(tt.password)
+		if !errors.Is(err, tt.err) {
+			t.Fatalf("%q: expected %v, got %v", tt.password, tt.err, err)
+		}
+	}
+
+	path := filepath.Join(t.TempDir(), "breached.txt")
+	err := os.WriteFile(path, []byte("correct horse battery staple\n"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = p.LoadBlocklist(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !errors.Is(p.Validate("correct horse battery staple"), password.ErrCommon) {
+		t.Fatal("expected password from the loaded list to be rejected")
+	}
+}
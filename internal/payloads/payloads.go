@@ -4,6 +4,10 @@ import (
 	"encoding/json"
 	"log"
 	"net/http"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/database"
 )
 
 type ChirpPostBody struct {
@@ -20,31 +24,348 @@ type UsersPostBody struct {
 	Password string `json:"password"`
 }
 
-type CreateUserResponse struct {
-	Email       string `json:"email"`
-	ID          int    `json:"id"`
-	IsChirpyRed bool   `json:"is_chirpy_red"`
+// PublicUser is the profile any caller may see. database.User must never be
+// written to a response directly, as it carries the password hash.
+type PublicUser struct {
+	ID          int  `json:"id"`
+	IsChirpyRed bool `json:"is_chirpy_red"`
+}
+
+// PrivateUser is the profile returned to the account owner.
+type PrivateUser struct {
+	Email            string       `json:"email"`
+	EmailVerified    bool         `json:"email_verified"`
+	TwoFactorEnabled bool         `json:"two_factor_enabled"`
+	ID               int          `json:"id"`
+	IsChirpyRed      bool         `json:"is_chirpy_red"`
+	Role             string       `json:"role"`
+	Settings         UserSettings `json:"settings"`
+}
+
+type UserSettings struct {
+	DefaultChirpSort string `json:"default_chirp_sort"`
+}
+
+func NewPublicUser(u *database.User) PublicUser {
+	return PublicUser{
+		ID:          u.ID,
+		IsChirpyRed: u.IsChirpyRed,
+	}
+}
+
+func NewPrivateUser(u *database.User) PrivateUser {
+	role := u.Role
+	if role == "" {
+		role = auth.RoleUser
+	}
+	return PrivateUser{
+		Email:            u.Email,
+		EmailVerified:    u.Verified(),
+		TwoFactorEnabled: u.TwoFactorEnabled(),
+		ID:               u.ID,
+		IsChirpyRed:      u.IsChirpyRed,
+		Role:             role,
+		Settings: UserSettings{
+			DefaultChirpSort: u.Settings.DefaultChirpSort,
+		},
+	}
 }
 
 type LoginRequest struct {
 	Email    string `json:"email"`
 	Password string `json:"password"`
+	// Device labels the session, defaulting to the User-Agent
+	Device string `json:"device"`
+	// ExpiresInSeconds shortens the access token, up to the server maximum
+	ExpiresInSeconds int `json:"expires_in_seconds"`
 }
 
 type LoginResponse struct {
-	Email        string `json:"email"`
-	ID           int    `json:"id"`
-	IsChirpyRed  bool   `json:"is_chirpy_red"`
+	Email         string `json:"email"`
+	EmailVerified bool   `json:"email_verified"`
+	ID            int    `json:"id"`
+	IsChirpyRed   bool   `json:"is_chirpy_red"`
+	Token         string `json:"token"`
+	ExpiresIn     int    `json:"expires_in"`
+	RefreshToken  string `json:"refresh_token"`
+}
+
+// MFAChallengeResponse answers a correct password for an account with
+// two-factor authentication. The challenge is exchanged for a LoginResponse
+// together with a code.
+type MFAChallengeResponse struct {
+	MFARequired    bool   `json:"mfa_required"`
+	ChallengeToken string `json:"challenge_token"`
+	ExpiresIn      int    `json:"expires_in"`
+}
+
+type LoginTOTPRequest struct {
+	ChallengeToken string `json:"challenge_token"`
+	// Code is a TOTP code or one of the recovery codes
+	Code             string `json:"code"`
+	Device           string `json:"device"`
+	ExpiresInSeconds int    `json:"expires_in_seconds"`
+}
+
+type RefreshResponse struct {
 	Token        string `json:"token"`
+	ExpiresIn    int    `json:"expires_in"`
 	RefreshToken string `json:"refresh_token"`
 }
 
+type SessionResponse struct {
+	ID         string    `json:"id"`
+	ClientID   string    `json:"client_id,omitempty"`
+	Device     string    `json:"device"`
+	IP         string    `json:"ip"`
+	UserAgent  string    `json:"user_agent"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastUsedAt time.Time `json:"last_used_at"`
+}
+
+func NewSessionResponse(s database.Session) SessionResponse {
+	return SessionResponse{
+		ID:         s.ID,
+		ClientID:   s.ClientID,
+		Device:     s.Device,
+		IP:         s.IP,
+		UserAgent:  s.UserAgent,
+		CreatedAt:  s.CreatedAt,
+		LastUsedAt: s.LastUsedAt,
+	}
+}
+
+type PersonalTokenRequest struct {
+	Name   string   `json:"name"`
+	Scopes []string `json:"scopes"`
+	// ExpiresInSeconds of 0 makes a token that never expires
+	ExpiresInSeconds int `json:"expires_in_seconds"`
+}
+
+type PersonalTokenResponse struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Scopes     []string   `json:"scopes"`
+	CreatedAt  time.Time  `json:"created_at"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	// Token is only included when the token is created
+	Token string `json:"token,omitempty"`
+}
+
+func NewPersonalTokenResponse(pt *database.PersonalToken) PersonalTokenResponse {
+	return PersonalTokenResponse{
+		ID:         pt.ID,
+		Name:       pt.Name,
+		Scopes:     pt.Scopes,
+		CreatedAt:  pt.CreatedAt,
+		ExpiresAt:  pt.ExpiresAt,
+		LastUsedAt: pt.LastUsedAt,
+	}
+}
+
+type OAuthClientRequest struct {
+	Name         string   `json:"name"`
+	RedirectURIs []string `json:"redirect_uris"`
+	Scopes       []string `json:"scopes"`
+	// Confidential clients can keep a secret, e.g. server-side apps
+	Confidential bool `json:"confidential"`
+}
+
+type OAuthClientResponse struct {
+	ClientID     string    `json:"client_id"`
+	Name         string    `json:"name"`
+	RedirectURIs []string  `json:"redirect_uris"`
+	Scopes       []string  `json:"scopes"`
+	Confidential bool      `json:"confidential"`
+	CreatedAt    time.Time `json:"created_at"`
+	// ClientSecret is only included when a confidential client is created
+	ClientSecret string `json:"client_secret,omitempty"`
+}
+
+func NewOAuthClientResponse(c *database.OAuthClient) OAuthClientResponse {
+	return OAuthClientResponse{
+		ClientID:     c.ID,
+		Name:         c.Name,
+		RedirectURIs: c.RedirectURIs,
+		Scopes:       c.Scopes,
+		Confidential: c.Confidential(),
+		CreatedAt:    c.CreatedAt,
+	}
+}
+
+// OAuthAuthorizeRequest carries the parameters of an authorization request,
+// RFC 6749 section 4.1.1, and the user's decision on it.
+type OAuthAuthorizeRequest struct {
+	ResponseType        string `json:"response_type"`
+	ClientID            string `json:"client_id"`
+	RedirectURI         string `json:"redirect_uri"`
+	Scope               string `json:"scope"`
+	State               string `json:"state"`
+	CodeChallenge       string `json:"code_challenge"`
+	CodeChallengeMethod string `json:"code_challenge_method"`
+	Approve             bool   `json:"approve"`
+}
+
+// OAuthConsentResponse describes an authorization request for the consent
+// screen.
+type OAuthConsentResponse struct {
+	ClientID    string   `json:"client_id"`
+	ClientName  string   `json:"client_name"`
+	RedirectURI string   `json:"redirect_uri"`
+	Scopes      []string `json:"scopes"`
+}
+
+type OAuthAuthorizeResponse struct {
+	RedirectTo string `json:"redirect_to"`
+}
+
+// OAuthTokenResponse is the token endpoint response of RFC 6749 section 5.1.
+type OAuthTokenResponse struct {
+	AccessToken  string `json:"access_token"`
+	TokenType    string `json:"token_type"`
+	ExpiresIn    int    `json:"expires_in"`
+	RefreshToken string `json:"refresh_token"`
+	Scope        string `json:"scope"`
+}
+
+type OAuthErrorResponse struct {
+	Error            string `json:"error"`
+	ErrorDescription string `json:"error_description,omitempty"`
+}
+
+// IntrospectionResponse follows RFC 7662 section 2.2. Inactive tokens are
+// described by Active alone.
+type IntrospectionResponse struct {
+	Active    bool   `json:"active"`
+	Scope     string `json:"scope,omitempty"`
+	ClientID  string `json:"client_id,omitempty"`
+	Subject   string `json:"sub,omitempty"`
+	TokenType string `json:"token_type,omitempty"`
+	ExpiresAt int64  `json:"exp,omitempty"`
+	IssuedAt  int64  `json:"iat,omitempty"`
+}
+
 type UpdateRequest struct {
-	ID       int    `json:"id"`
-	Email    string `json:"email"`
+	ID              int    `json:"id"`
+	Email           string `json:"email"`
+	Password        string `json:"password"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type EmailChangeRequest struct {
+	Email           string `json:"email"`
+	CurrentPassword string `json:"current_password"`
+}
+
+type PasswordChangeRequest struct {
+	CurrentPassword string `json:"current_password"`
+	NewPassword     string `json:"new_password"`
+}
+
+type PasswordResetRequest struct {
+	Email string `json:"email"`
+}
+
+type PasswordResetConfirmRequest struct {
+	Token       string `json:"token"`
+	NewPassword string `json:"new_password"`
+}
+
+type TOTPEnrolRequest struct {
+	Password string `json:"password"`
+}
+
+type TOTPEnrolResponse struct {
+	Secret string `json:"secret"`
+	URI    string `json:"uri"`
+}
+
+type TOTPCodeRequest struct {
+	Code string `json:"code"`
+}
+
+type RecoveryCodesResponse struct {
+	RecoveryCodes []string `json:"recovery_codes"`
+}
+
+type TOTPDisableRequest struct {
 	Password string `json:"password"`
 }
 
+type RoleRequest struct {
+	Role string `json:"role"`
+}
+
+// StatsResponse is the admin overview of the server.
+type StatsResponse struct {
+	Hits      int64                `json:"hits"`
+	Users     int                  `json:"users"`
+	Chirps    int                  `json:"chirps"`
+	ChirpyRed int                  `json:"chirpy_red"`
+	Signups   []DailyCountResponse `json:"signups"`
+}
+
+type DailyCountResponse struct {
+	Day   string `json:"day"`
+	Count int    `json:"count"`
+}
+
+func NewStatsResponse(hits int64, s *database.Stats) StatsResponse {
+	signups := []DailyCountResponse{}
+	for _, d := range s.Signups {
+		signups = append(signups, DailyCountResponse{Day: d.Day, Count: d.Count})
+	}
+	return StatsResponse{
+		Hits:      hits,
+		Users:     s.Users,
+		Chirps:    s.Chirps,
+		ChirpyRed: s.ChirpyRed,
+		Signups:   signups,
+	}
+}
+
+type DeleteAccountRequest struct {
+	Password string `json:"password"`
+}
+
+type DeleteAccountResponse struct {
+	PurgeAt time.Time `json:"purge_at"`
+}
+
+type ExportResponse struct {
+	ID          string     `json:"id"`
+	Status      string     `json:"status"`
+	CreatedAt   time.Time  `json:"created_at"`
+	CompletedAt *time.Time `json:"completed_at,omitempty"`
+	ExpiresAt   *time.Time `json:"expires_at,omitempty"`
+}
+
+func NewExportResponse(e *database.Export) ExportResponse {
+	return ExportResponse{
+		ID:          e.ID,
+		Status:      string(e.Status),
+		CreatedAt:   e.CreatedAt,
+		CompletedAt: e.CompletedAt,
+		ExpiresAt:   e.ExpiresAt,
+	}
+}
+
+// UserPatchRequest holds a partial account update; nil fields are left as they are.
+// Password is only decoded so that it can be rejected: passwords are changed
+// through PasswordChangeRequest.
+type UserPatchRequest struct {
+	Email *string `json:"email"`
+	// CurrentPassword is required to change the email
+	CurrentPassword string             `json:"current_password"`
+	Password        *string            `json:"password"`
+	Settings        *UserSettingsPatch `json:"settings"`
+}
+
+type UserSettingsPatch struct {
+	DefaultChirpSort *string `json:"default_chirp_sort"`
+}
+
 func DecodeRequest[T any](r *http.Request, dest *T) error {
 	decoder := json.NewDecoder(r.Body)
 	err := decoder.Decode(&dest)
@@ -0,0 +1,61 @@
+package payloads_test
+
+import (
+	"encoding/json"
+	"testing"
+
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+// every payload built from a user must leave the password hash behind
+func TestUserResponsesOmitPassword(t *testing.T) {
+	user := &database.User{
+		ID:          1,
+		Email:       "user@example.com",
+		Password:    "$2a$04$not.a.real.hash",
+		IsChirpyRed: true,
+	}
+	responses := map[string]interface{}{
+		"public":  payloads.NewPublicUser(user),
+		"private": payloads.NewPrivateUser(user),
+		"login": payloads.LoginResponse{
+			Email:        user.Email,
+			ID:           user.ID,
+			IsChirpyRed:  user.IsChirpyRed,
+			Token:        "access",
+			RefreshToken: "refresh",
+		},
+	}
+	for name, res := range responses {
+		data, err := json.Marshal(res)
+		if err != nil {
+			t.Fatalf("Test 'UserResponsesOmitPassword' failed: %s: %s", name, err.Error())
+		}
+		body := map[string]interface{}{}
+		err = json.Unmarshal(data, &body)
+		if err != nil {
+			t.Fatalf("Test 'UserResponsesOmitPassword' failed: %s: %s", name, err.Error())
+		}
+		if _, ok := body["password"]; ok {
+			t.Fatalf("Test 'UserResponsesOmitPassword' failed: %s response contains a password field", name)
+		}
+	}
+}
+
+// the public profile must not expose the account email either
+func TestPublicUserOmitsEmail(t *testing.T) {
+	user := &database.User{ID: 1, Email: "user@example.com"}
+	data, err := json.Marshal(payloads.NewPublicUser(user))
+	if err != nil {
+		t.Fatalf("Test 'PublicUserOmitsEmail' failed: %s", err.Error())
+	}
+	body := map[string]interface{}{}
+	err = json.Unmarshal(data, &body)
+	if err != nil {
+		t.Fatalf("Test 'PublicUserOmitsEmail' failed: %s", err.Error())
+	}
+	if _, ok := body["email"]; ok {
+		t.Fatal("Test 'PublicUserOmitsEmail' failed: public response contains an email field")
+	}
+}
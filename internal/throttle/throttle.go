@@ -0,0 +1,147 @@
+package throttle
+
+import (
+	"sync"
+	"time"
+)
+
+// Policy describes how quickly a key is slowed down by repeated failures.
+type Policy struct {
+	// FreeAttempts failures are allowed before any delay applies
+	FreeAttempts int
+	// BaseDelay is the wait after the first counted failure, doubling with
+	// each further one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// LockoutAfter failures block the key for LockoutDuration
+	LockoutAfter    int
+	LockoutDuration time.Duration
+	// Window is how long a key must stay quiet for its failures to be forgotten
+	Window time.Duration
+}
+
+// Throttle tracks failures per key, e.g. an account or an IP address, and
+// tells callers how long to wait before the key may try again.
+type Throttle struct {
+	mu      sync.Mutex
+	policy  Policy
+	entries map[string]*entry
+	now     func() time.Time
+}
+
+type entry struct {
+	failures     int
+	lastFailure  time.Time
+	blockedUntil time.Time
+}
+
+// New returns a throttle. now is the clock to use, time.Now when nil.
+func New(policy Policy, now func() time.Time) *Throttle {
+	if now == nil {
+		now = time.Now
+	}
+	return &Throttle{
+		policy:  policy,
+		entries: map[string]*entry{},
+		now:     now,
+	}
+}
+
+// Allow reports whether key may make an attempt now and, if not, how long
+// it has to wait. An allowed attempt is counted as a failure straight away,
+// so that concurrent attempts cannot all slip through before any of them
+// fails; call Release once it succeeds.
+func (t *Throttle) Allow(key string) (time.Duration, bool) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.lookup(key)
+	if e != nil {
+		wait := e.blockedUntil.Sub(t.now())
+		if wait > 0 {
+			return wait, false
+		}
+	}
+	t.fail(key, e)
+	return 0, true
+}
+
+// Release gives back an attempt allowed for key that turned out to succeed.
+func (t *Throttle) Release(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	e := t.lookup(key)
+	if e == nil {
+		return
+	}
+	e.failures--
+	if e.failures <= 0 {
+		delete(t.entries, key)
+		return
+	}
+	e.blockedUntil = time.Time{}
+	t.penalise(e)
+}
+
+// Fail records a failed attempt for key that was not counted by Allow.
+func (t *Throttle) Fail(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.fail(key, t.lookup(key))
+}
+
+// fail counts a failure against key, whose current entry is e; the caller
+// holds the lock.
+func (t *Throttle) fail(key string, e *entry) {
+	if e == nil {
+		e = &entry{}
+		t.entries[key] = e
+	}
+	e.failures++
+	e.lastFailure = t.now()
+	t.penalise(e)
+}
+
+// penalise blocks e for as long as its failures call for, counting from
+// the last one.
+func (t *Throttle) penalise(e *entry) {
+	switch {
+	case t.policy.LockoutAfter > 0 && e.failures >= t.policy.LockoutAfter:
+		e.blockedUntil = e.lastFailure.Add(t.policy.LockoutDuration)
+	case e.failures > t.policy.FreeAttempts:
+		delay := t.policy.BaseDelay << (e.failures - t.policy.FreeAttempts - 1)
+		if delay > t.policy.MaxDelay || delay <= 0 {
+			delay = t.policy.MaxDelay
+		}
+		e.blockedUntil = e.lastFailure.Add(delay)
+	}
+}
+
+// Reset forgets every failure recorded for key, lifting any lockout.
+func (t *Throttle) Reset(key string) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	delete(t.entries, key)
+}
+
+// Prune drops keys whose failures have been forgotten, bounding memory use.
+func (t *Throttle) Prune() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for key := range t.entries {
+		t.lookup(key)
+	}
+}
+
+// lookup returns the entry for key, discarding it once it has expired.
+func (t *Throttle) lookup(key string) *entry {
+	e, ok := t.entries[key]
+	if !ok {
+		return nil
+	}
+	now := t.now()
+	if now.After(e.blockedUntil) && now.Sub(e.lastFailure) > t.policy.Window {
+		delete(t.entries, key)
+		return nil
+	}
+	return e
+}
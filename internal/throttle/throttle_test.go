@@ -0,0 +1,113 @@
+package throttle_test
+
+import (
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/throttle"
+)
+
+type clock struct {
+	now time.Time
+}
+
+func (c *clock) Now() time.Time {
+	return c.now
+}
+
+var policy = throttle.Policy{
+	FreeAttempts:    2,
+	BaseDelay:       time.Second,
+	MaxDelay:        time.Second * 8,
+	LockoutAfter:    8,
+	LockoutDuration: time.Minute * 15,
+	Window:          time.Hour,
+}
+
+// each failure past the free attempts doubles the wait, up to the maximum
+func TestBackoff(t *testing.T) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	th := throttle.New(policy, c.Now)
+	// allowed attempts count as failures until released
+	for i := 0; i < policy.FreeAttempts+1; i++ {
+		if _, ok := th.Allow("key"); !ok {
+			t.Fatalf("attempt %d: expected to be allowed", i+1)
+		}
+	}
+	expected := []time.Duration{time.Second, time.Second * 2, time.Second * 4, time.Second * 8, time.Second * 8}
+	for i, want := range expected {
+		wait, ok := th.Allow("key")
+		if ok || wait != want {
+			t.Fatalf("failure %d: expected wait %v, got %v (allowed %v)", policy.FreeAttempts+i+1, want, wait, ok)
+		}
+		c.now = c.now.Add(wait)
+		if _, ok := th.Allow("key"); !ok {
+			t.Fatalf("expected an attempt after waiting %v", wait)
+		}
+	}
+	if _, ok := th.Allow("other"); !ok {
+		t.Fatal("expected other keys to be unaffected")
+	}
+}
+
+// attempts in flight hold their slots, so concurrent attempts cannot all
+// get through; successful ones give them back
+func TestRelease(t *testing.T) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	th := throttle.New(policy, c.Now)
+	var wg sync.WaitGroup
+	var allowed atomic.Int32
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if _, ok := th.Allow("key"); ok {
+				allowed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	if int(allowed.Load()) != policy.FreeAttempts+1 {
+		t.Fatalf("expected %d attempts to be allowed, got %d", policy.FreeAttempts+1, allowed.Load())
+	}
+	for i := 0; i < policy.FreeAttempts+1; i++ {
+		th.Release("key")
+	}
+	for i := 0; i < policy.FreeAttempts+1; i++ {
+		if _, ok := th.Allow("key"); !ok {
+			t.Fatalf("attempt %d: expected released slots to be free again", i+1)
+		}
+	}
+}
+
+func TestLockoutAndReset(t *testing.T) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	th := throttle.New(policy, c.Now)
+	for i := 0; i < policy.LockoutAfter; i++ {
+		th.Fail("key")
+	}
+	wait, ok := th.Allow("key")
+	if ok || wait != policy.LockoutDuration {
+		t.Fatalf("expected lockout of %v, got %v", policy.LockoutDuration, wait)
+	}
+	th.Reset("key")
+	if _, ok := th.Allow("key"); !ok {
+		t.Fatal("expected reset to lift the lockout")
+	}
+}
+
+func TestWindowForgetsFailures(t *testing.T) {
+	c := &clock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+	th := throttle.New(policy, c.Now)
+	for i := 0; i < policy.FreeAttempts+1; i++ {
+		th.Fail("key")
+	}
+	c.now = c.now.Add(policy.Window + time.Second)
+	th.Prune()
+	th.Fail("key")
+	if _, ok := th.Allow("key"); !ok {
+		t.Fatal("expected failures outside the window to be forgotten")
+	}
+}
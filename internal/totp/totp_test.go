@@ -0,0 +1,71 @@
+package totp_test
+
+import (
+	"encoding/base32"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/totp"
+)
+
+// the SHA-1 test vectors of RFC 6238 appendix B, truncated to 6 digits
+func TestCode(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString([]byte("12345678901234567890"))
+	tests := []struct {
+		unix int64
+		code string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+	for _, tt := range tests {
+		code, err := totp.Code(secret, totp.Counter(time.Unix(tt.unix, 0)))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if code != tt.code {
+			t.Fatalf("at %d: expected %s, got %s", tt.unix, tt.code, code)
+		}
+	}
+}
+
+func TestValidate(t *testing.T) {
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	now := time.Unix(1700000000, 0)
+	code, err := totp.Code(secret, totp.Counter(now))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if counter, ok := totp.Validate(secret, code, now); !ok || counter != totp.Counter(now) {
+		t.Fatal("expected current code to validate")
+	}
+	if _, ok := totp.Validate(secret, code, now.Add(totp.Period)); !ok {
+		t.Fatal("expected code from the previous step to validate")
+	}
+	if _, ok := totp.Validate(secret, code, now.Add(totp.Period*2)); ok {
+		t.Fatal("expected code from two steps ago to be rejected")
+	}
+	if _, ok := totp.Validate(secret, "12345", now); ok {
+		t.Fatal("expected short code to be rejected")
+	}
+}
+
+func TestURI(t *testing.T) {
+	uri := totp.URI("Chirpy", "someone@example.com", "JBSWY3DPEHPK3PXP")
+	if !strings.HasPrefix(uri, "otpauth://totp/Chirpy:someone@example.com?") {
+		t.Fatalf("unexpected label in %s", uri)
+	}
+	for _, want := range []string{"secret=JBSWY3DPEHPK3PXP", "issuer=Chirpy", "digits=6", "period=30"} {
+		if !strings.Contains(uri, want) {
+			t.Fatalf("expected %s in %s", want, uri)
+		}
+	}
+}
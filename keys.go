@@ -0,0 +1,65 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+)
+
+const keyRingReloadInterval time.Duration = time.Minute
+
+// loadKeyRing reads the key ring at path, seeding it with the configured
+// signing key the first time.
+func loadKeyRing(path string, seed *auth.Key, now func() time.Time) (*auth.KeyRing, error) {
+	ring, err := auth.LoadKeyRing(path)
+	if errors.Is(err, os.ErrNotExist) {
+		ring = auth.NewKeyRing(seed, now)
+		err = ring.Save(path)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ring, nil
+}
+
+// reloadKeyRing picks up rotations made by `chirpy keys rotate` while the
+// server is running.
+func (cfg *apiConfig) reloadKeyRing() {
+	ticker := time.NewTicker(keyRingReloadInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		ring, err := auth.LoadKeyRing(cfg.keyRingPath)
+		if err != nil {
+			log.Printf("Failed to reload JWT key ring: %v", err)
+			continue
+		}
+		cfg.authenticator.SetKeyRing(ring)
+	}
+}
+
+// rotateKeys generates a new active signing key. The previous key keeps
+// verifying tokens until the longest token lifetime has passed.
+func (cfg *apiConfig) rotateKeys() error {
+	if cfg.keyRingPath == "" {
+		return errors.New("JWT_KEYRING_FILE must be set to rotate keys")
+	}
+	ring, err := auth.LoadKeyRing(cfg.keyRingPath)
+	if err != nil {
+		return err
+	}
+	key, err := auth.GenerateKey(ring.Active().Method)
+	if err != nil {
+		return err
+	}
+	ring.Rotate(key, cfg.now(), cfg.authenticator.MaxLifetime())
+	err = ring.Save(cfg.keyRingPath)
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Rotated JWT signing key, new key ID %s\n", key.ID)
+	return nil
+}
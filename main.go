@@ -1,55 +1,115 @@
 package main
 
 import (
+	"crypto/subtle"
 	"encoding/json"
 	"errors"
+	"flag"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"os"
-	"strconv"
-	"strings"
+	"sync/atomic"
+	"time"
 
-	"github.com/am1macdonald/chirpy/internal/chirps"
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/config"
 	"github.com/am1macdonald/chirpy/internal/database"
-	"github.com/am1macdonald/chirpy/internal/payloads"
-	"github.com/golang-jwt/jwt/v5"
-
-	"github.com/joho/godotenv"
-)
-
-var mux http.ServeMux
-var corsMux http.Handler
-var server http.Server
-var config apiConfig
-
-const (
-	port string = ":8080"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/am1macdonald/chirpy/internal/password"
+	"github.com/am1macdonald/chirpy/internal/throttle"
 )
 
-var db *database.DB
-
+// apiConfig is the configuration and shared state the handlers run with.
 type apiConfig struct {
-	fileServerHits int
-	jwtSecret      string
-	polkaKey       string
+	// now is the clock, time.Now outside of tests
+	now              func() time.Time
+	db               *database.DB
+	fileServerHits   atomic.Int64
+	jwtSecret        string
+	polkaKey         string
+	authenticator    *auth.Authenticator
+	keyRingPath      string
+	refreshTTL       time.Duration
+	adminKey         string
+	metricsToken     string
+	loginAccounts    *throttle.Throttle
+	loginIPs         *throttle.Throttle
+	deletionGrace    time.Duration
+	chirpPolicy      database.ChirpPolicy
+	passwords        *password.Policy
+	mailer           mail.Mailer
+	publicURL        string
+	verifications    *throttle.Throttle
+	passwordResets   *throttle.Throttle
+	passwordResetTTL time.Duration
+	// exportDir holds the archives of data exports
+	exportDir string
+	// dummyUser is checked against when a login names no account
+	dummyUser *database.User
 }
 
+const purgeInterval time.Duration = time.Hour
+
 func (cfg *apiConfig) middlewareMetricsInc(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		cfg.fileServerHits++
+		cfg.fileServerHits.Add(1)
 		next.ServeHTTP(w, r)
 	})
 }
 
 func (cfg *apiConfig) resetCounter() {
-	cfg.fileServerHits = 0
+	cfg.fileServerHits.Store(0)
+}
+
+// purgeDeletedUsers periodically removes accounts whose deletion grace period
+// has passed, along with expired data exports, refresh tokens, password
+// reset tokens, OAuth authorization codes and used login challenges.
+func (cfg *apiConfig) purgeDeletedUsers() {
+	ticker := time.NewTicker(purgeInterval)
+	defer ticker.Stop()
+	for ; ; <-ticker.C {
+		cfg.loginAccounts.Prune()
+		cfg.loginIPs.Prune()
+		cfg.verifications.Prune()
+		cfg.passwordResets.Prune()
+		cfg.removeExpiredExports()
+		err := cfg.db.DeleteExpiredRefreshTokens(cfg.now())
+		if err != nil {
+			log.Printf("Failed to delete expired refresh tokens: %v", err)
+		}
+		err = cfg.db.DeleteExpiredPasswordResets(cfg.now())
+		if err != nil {
+			log.Printf("Failed to delete expired password resets: %v", err)
+		}
+		err = cfg.db.DeleteExpiredOAuthCodes(cfg.now())
+		if err != nil {
+			log.Printf("Failed to delete expired authorization codes: %v", err)
+		}
+		err = cfg.db.DeleteExpiredLoginChallenges(cfg.now())
+		if err != nil {
+			log.Printf("Failed to delete expired login challenges: %v", err)
+		}
+		n, exports, err := cfg.db.PurgeDeletedUsers(cfg.now().Add(-cfg.deletionGrace), cfg.chirpPolicy)
+		if err != nil {
+			log.Printf("Failed to purge deleted users: %v", err)
+			continue
+		}
+		for _, export := range exports {
+			os.Remove(export.Path)
+		}
+		if n > 0 {
+			log.Printf("Purged %d deleted users", n)
+		}
+	}
 }
 
 func middlewareCors(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		w.Header().Set("Access-Control-Allow-Origin", "*")
-		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, OPTIONS, DELETE")
+		w.Header().Set("Access-Control-Allow-Methods", "GET, POST, PUT, PATCH, OPTIONS, DELETE")
 		w.Header().Set("Access-Control-Allow-Headers", "*")
 		if r.Method == "OPTIONS" {
 			w.WriteHeader(http.StatusOK)
@@ -76,383 +136,219 @@ func errorResponse(w http.ResponseWriter, code int, err error) {
 	return
 }
 
-func init() {
-	err := godotenv.Load()
-	if err != nil {
-		log.Fatal("Error loading .env file")
-	}
-	config = apiConfig{}
-	config.jwtSecret = os.Getenv("JWT_SECRET")
-	config.polkaKey = os.Getenv("POLKA_API_KEY")
-	mux = *http.NewServeMux()
-	corsMux = middlewareCors(&mux)
-	server = http.Server{}
-	server.Addr = port
-	server.Handler = corsMux
-	dbp, err := database.NewDB()
-	if err != nil {
-		log.Fatalln("Failed to load database")
+// passwordPolicy builds the password hashing and strength policy. Existing
+// hashes are upgraded to it as users log in.
+func passwordPolicy(c *config.Config) (*password.Policy, error) {
+	p := password.DefaultPolicy()
+	p.Algorithm = c.PasswordHash
+	p.BcryptCost = c.BcryptCost
+	p.Argon2.Memory = uint32(c.Argon2MemoryKiB)
+	p.Argon2.Iterations = uint32(c.Argon2Iterations)
+	p.Argon2.Parallelism = uint8(c.Argon2Parallelism)
+	p.MinLength = c.PasswordMinLength
+	if c.PasswordBlocklistFile != "" {
+		err := p.LoadBlocklist(c.PasswordBlocklistFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load password blocklist: %w", err)
+		}
 	}
-	db = dbp
+	return p, nil
 }
 
-func getTokenString(r *http.Request) (string, error) {
-	ts := r.Header.Get("Authorization")
-	if ts == "" {
-		return "", errors.New("Authorization header is required")
+// newMailer sends through SMTP_ADDR when it is set. Otherwise messages are
+// written to MAIL_DIR, or to the log, for development.
+func newMailer(c *config.Config) (mail.Mailer, error) {
+	if c.SMTPAddr != "" {
+		m, err := mail.NewSMTPMailer(c.SMTPAddr, c.MailFrom, c.SMTPUsername, c.SMTPPassword)
+		if err != nil {
+			return nil, fmt.Errorf("invalid SMTP configuration: %w", err)
+		}
+		return m, nil
 	}
-	return strings.Split(ts, " ")[1], nil
-
-}
-
-func parseTokenString(t string) (*jwt.Token, error) {
-	claims := jwt.MapClaims{}
-	return jwt.ParseWithClaims(t, claims, func(t *jwt.Token) (interface{}, error) {
-		return []byte(config.jwtSecret), nil
-	})
+	if c.MailDir != "" {
+		return &mail.FileMailer{Dir: c.MailDir, From: c.MailFrom}, nil
+	}
+	return mail.NewLogMailer(os.Stderr, c.MailFrom), nil
 }
 
-func getUserFromToken(t jwt.Token) (*database.User, error) {
-	userID, err := t.Claims.GetSubject()
+// newConfig builds the server state from a validated configuration, loading
+// keys and opening the database. now is the clock, time.Now outside of tests.
+func newConfig(c *config.Config, now func() time.Time) (*apiConfig, error) {
+	var err error
+	cfg := &apiConfig{now: now}
+	cfg.jwtSecret = c.JWTSecret
+	cfg.polkaKey = c.PolkaAPIKey
+	cfg.adminKey = c.AdminAPIKey
+	cfg.metricsToken = c.MetricsToken
+	cfg.exportDir = c.ExportDir
+	cfg.loginAccounts = throttle.New(accountLoginPolicy, cfg.now)
+	cfg.loginIPs = throttle.New(ipLoginPolicy, cfg.now)
+	cfg.passwords, err = passwordPolicy(c)
 	if err != nil {
 		return nil, err
 	}
-	idInt, err := strconv.Atoi(userID)
+	cfg.mailer, err = newMailer(c)
 	if err != nil {
 		return nil, err
 	}
-	return db.GetUser(idInt)
-}
-
-func main() {
-	mux.Handle("/app/*", config.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))))
-
-	mux.HandleFunc("GET /api/healthz", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte("OK"))
-	})
-
-	// mux.HandleFunc("GET /api/metrics", func(w http.ResponseWriter, r *http.Request) {
-	// 	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-	// 	w.WriteHeader(http.StatusOK)
-	// 	w.Write([]byte(fmt.Sprintf("Hits: %v\n", config.fileServerHits)))
-	// })
-
-	mux.HandleFunc("GET /admin/metrics", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/html; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		w.Write([]byte(fmt.Sprintf(`
-<html>
-<body>
-    <h1>Welcome, Chirpy Admin</h1>
-    <p>Chirpy has been visited %d times!</p>
-</body>
-</html>`, config.fileServerHits)))
-	})
-
-	mux.HandleFunc("/api/reset", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
-		w.WriteHeader(http.StatusOK)
-		config.resetCounter()
-		w.Write([]byte("OK"))
-	})
-
-	mux.HandleFunc("POST /api/chirps", func(w http.ResponseWriter, r *http.Request) {
-		ts, err := getTokenString(r)
-		if err != nil {
-			errorResponse(w, 500, err)
-			return
-		}
-		token, err := parseTokenString(ts)
-		if err != nil {
-			errorResponse(w, 500, err)
-			return
-		}
-		issuer, err := token.Claims.GetIssuer()
-		if err != nil || issuer != "chirpy-access" {
-			log.Println("Invalid token")
-			errorResponse(w, 401, errors.New("invalid token"))
-			return
-		}
-		user, err := getUserFromToken(*token)
-		if err != nil {
-			errorResponse(w, 500, err)
-			return
-		}
-		req := payloads.ChirpPostBody{}
-		err = payloads.DecodeRequest(r, &req)
-		if err != nil {
-			errorResponse(w, 500, err)
-			return
-		}
-		s, err := chirps.Validate(req.Body)
-		if err != nil {
-			errorResponse(w, 400, err)
-			return
-		}
-		chirp, err := db.CreateChirp(s, user.ID)
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		jsonResponse(w, 201, chirp)
-	})
-
-	mux.HandleFunc("GET /api/chirps", config.GetChirpsHandler)
-
-	mux.HandleFunc("GET /api/chirps/{chirp_id}", func(w http.ResponseWriter, r *http.Request) {
-		id, err := strconv.Atoi(r.PathValue("chirp_id"))
+	cfg.publicURL = c.PublicURL
+	cfg.verifications = throttle.New(verificationPolicy, cfg.now)
+	cfg.passwordResets = throttle.New(passwordResetPolicy, cfg.now)
+	cfg.passwordResetTTL = c.PasswordResetTTL
+	cfg.dummyUser = &database.User{}
+	err = cfg.dummyUser.UpdatePassword(cfg.passwords, "not a real password")
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash dummy password: %w", err)
+	}
+	signingKey := auth.NewHMACKey(c.JWTKeyID, []byte(cfg.jwtSecret))
+	if c.JWTSigningKeyFile != "" {
+		signingKey, err = auth.LoadPrivateKeyFile(c.JWTKeyID, c.JWTSigningKeyFile)
 		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
+			return nil, fmt.Errorf("failed to load JWT signing key: %w", err)
 		}
-		chirp, err := db.GetChirp(id)
+	}
+	ring := auth.NewKeyRing(signingKey, now)
+	cfg.keyRingPath = c.JWTKeyRingFile
+	if cfg.keyRingPath != "" {
+		ring, err = loadKeyRing(cfg.keyRingPath, signingKey, now)
 		if err != nil {
-			jsonResponse(w, 404, err.Error())
-			return
+			return nil, fmt.Errorf("failed to load JWT key ring: %w", err)
 		}
-		jsonResponse(w, 200, chirp)
-	})
+	}
+	tokenConfig := auth.DefaultTokenConfig()
+	tokenConfig.Now = cfg.now
+	tokenConfig.Issuer = c.JWTIssuer
+	tokenConfig.Audience = c.JWTAudience
+	tokenConfig.AccessLifetime = c.AccessTokenTTL
+	tokenConfig.Leeway = c.JWTLeeway
+	tokenConfig.VerifyEmailLifetime = c.VerifyEmailTTL
+	tokenConfig.MFALifetime = c.MFAChallengeTTL
+	cfg.authenticator = auth.NewAuthenticator(ring, tokenConfig)
+	cfg.deletionGrace = c.AccountDeletionGrace
+	cfg.refreshTTL = c.RefreshTokenTTL
+	cfg.chirpPolicy = database.ChirpPolicy(c.DeletedChirpsPolicy)
+	cfg.db, err = database.NewDB(c.DatabasePath, cfg.now)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load database: %w", err)
+	}
+	return cfg, nil
+}
 
-	mux.HandleFunc("POST /api/users", func(w http.ResponseWriter, r *http.Request) {
-		req := payloads.UsersPostBody{}
-		err := payloads.DecodeRequest(r, &req)
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		user, err := db.CreateUser(req.Email, req.Password)
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		pl := payloads.CreateUserResponse{
-			ID:          user.ID,
-			Email:       user.Email,
-			IsChirpyRed: user.IsChirpyRed,
-		}
-		jsonResponse(w, 201, pl)
-	})
+// isAdminRequest reports whether the request carries the admin API key.
+// Without ADMIN_API_KEY set, admin endpoints are disabled.
+func (cfg *apiConfig) isAdminRequest(r *http.Request) bool {
+	key, err := auth.ParseAuthorization(r.Header, "ApiKey")
+	return err == nil && cfg.adminKey != "" && subtle.ConstantTimeCompare([]byte(key), []byte(cfg.adminKey)) == 1
+}
 
-	mux.HandleFunc("PUT /api/users", func(w http.ResponseWriter, r *http.Request) {
-		req := payloads.UpdateRequest{}
-		err := payloads.DecodeRequest(r, &req)
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		ts := r.Header.Get("Authorization")
-		if ts == "" {
-			jsonResponse(w, 401, "Authorization header is required")
-			return
-		}
-		ts = strings.Split(ts, " ")[1]
-		log.Println(ts)
-		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(ts, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.jwtSecret), nil
-		})
-		issuer, err := claims.GetIssuer()
-		if err != nil || issuer == "chirpy-refresh" {
-			log.Println("Invalid token")
-			jsonResponse(w, 401, "invalid token")
-			return
-		}
-		userID, err := token.Claims.GetSubject()
-		if err != nil {
-			jsonResponse(w, 500, "no claims subject")
-			return
-		}
-		idInt, err := strconv.Atoi(userID)
-		if err != nil {
-			jsonResponse(w, 500, "failed to parse userID")
-			return
-		}
-		user, err := db.GetUser(idInt)
-		if err != nil {
-			log.Println("No user with id")
-			jsonResponse(w, 404, "User with id does not exist")
+// HandleMetrics serves Prometheus metrics. With METRICS_TOKEN set, scrapers
+// must send it as a bearer token.
+func (cfg *apiConfig) HandleMetrics(w http.ResponseWriter, r *http.Request) {
+	if cfg.metricsToken != "" {
+		token, err := auth.BearerToken(r.Header)
+		if err != nil || subtle.ConstantTimeCompare([]byte(token), []byte(cfg.metricsToken)) != 1 {
+			errorResponse(w, 401, errors.New("metrics token required"))
 			return
 		}
-		user.Email = req.Email
-		err = user.UpdatePassword(req.Password)
-		if err != nil {
-			jsonResponse(w, 500, "failed to update password")
-			return
-		}
-		user, err = db.UpdateUser(user)
-		if err != nil {
-			jsonResponse(w, 500, "Could not update user")
-			return
-		}
-		pl := payloads.CreateUserResponse{
-			ID:    user.ID,
-			Email: user.Email,
-		}
-		jsonResponse(w, 200, pl)
-	})
+	}
+	metrics.Handler().ServeHTTP(w, r)
+}
 
-	mux.HandleFunc("GET /api/users/{user_id}", func(w http.ResponseWriter, r *http.Request) {
-		id, err := strconv.Atoi(r.PathValue("user_id"))
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		chirp, err := db.GetUser(id)
-		if err != nil {
-			jsonResponse(w, 404, err.Error())
-			return
-		}
-		jsonResponse(w, 200, chirp)
-	})
+// clientIP is the address the request came from. X-Forwarded-For is not
+// trusted, as nothing guarantees a proxy in front of the server.
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
 
-	mux.HandleFunc("POST /api/login", func(w http.ResponseWriter, r *http.Request) {
-		req := payloads.LoginRequest{}
-		err := payloads.DecodeRequest(r, &req)
-		if err != nil {
-			jsonResponse(w, 500, err.Error())
-			return
-		}
-		user, err := db.GetUserByEmail(req.Email)
-		if err != nil {
-			jsonResponse(w, 400, err.Error())
-			return
-		}
-		valid := user.Validate(req.Password)
-		if !valid {
-			jsonResponse(w, 401, "Invalid password")
-			return
-		}
-		accessToken, err := user.GetAccessToken(config.jwtSecret)
-		if err != nil {
-			log.Printf("%v", err)
-			jsonResponse(w, 500, "Failed to generate access token")
-			return
-		}
-		refreshToken, err := user.GetRefreshToken(config.jwtSecret)
-		if err != nil {
-			log.Printf("%v", err)
-			jsonResponse(w, 500, "Failed to generate refresh token")
-			return
-		}
-		pl := payloads.LoginResponse{
-			Email:        user.Email,
-			ID:           user.ID,
-			IsChirpyRed:  user.IsChirpyRed,
-			Token:        accessToken,
-			RefreshToken: refreshToken,
-		}
-		log.Println("Here")
-		jsonResponse(w, 200, pl)
-	})
+// requestClient describes the caller for session records, labelling the
+// device with the User-Agent unless the client names it.
+func requestClient(r *http.Request) database.Client {
+	return database.Client{
+		Device:    r.UserAgent(),
+		IP:        clientIP(r),
+		UserAgent: r.UserAgent(),
+	}
+}
 
-	mux.HandleFunc("POST /api/refresh", func(w http.ResponseWriter, r *http.Request) {
-		ts := r.Header.Get("Authorization")
-		if ts == "" {
-			jsonResponse(w, 401, "Authorization header is required")
-			return
-		}
-		ts = strings.Split(ts, " ")[1]
-		log.Println(ts)
-		claims := jwt.MapClaims{}
-		token, err := jwt.ParseWithClaims(ts, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.jwtSecret), nil
-		})
-		if err != nil {
-			log.Println(err.Error())
-			jsonResponse(w, 401, "invalid token")
-			return
-		}
-		issuer, err := claims.GetIssuer()
-		if err != nil {
-			log.Println(err.Error())
-			jsonResponse(w, 401, "invalid token")
-			return
-		}
-		if issuer != "chirpy-refresh" {
-			log.Println("not a chirpy refresh token")
-			jsonResponse(w, 401, "invalid token")
-			return
-		}
-		ok, err := db.ValidateToken(ts)
-		if err != nil {
-			log.Println("failed to validate token")
-			jsonResponse(w, 500, "failed to validate token")
-			return
-		}
-		if !ok {
-			log.Println("token is invalid")
-			jsonResponse(w, 401, "token is invalid")
-			return
-		}
-		userID, err := token.Claims.GetSubject()
-		if err != nil {
-			jsonResponse(w, 500, "no claims subject")
-			return
-		}
-		idInt, err := strconv.Atoi(userID)
-		if err != nil {
-			jsonResponse(w, 500, "failed to parse userID")
-			return
-		}
-		user, err := db.GetUser(idInt)
-		if err != nil {
-			log.Println("No user with id")
-			jsonResponse(w, 404, "User with id does not exist")
-			return
-		}
-		accessToken, err := user.GetAccessToken(config.jwtSecret)
-		if err != nil {
-			log.Println("Failed to refresh access token")
-			jsonResponse(w, 500, "failed to refresh access token")
-			return
-		}
-		jsonResponse(w, 200, map[string]string{
-			"token": accessToken,
-		})
-	})
+// currentUser loads the user behind the principal the auth middleware put on
+// the request, rejecting accounts pending deletion and revoked tokens.
+func (cfg *apiConfig) currentUser(r *http.Request) (*database.User, error) {
+	p, ok := auth.PrincipalFrom(r.Context())
+	if !ok {
+		return nil, auth.ErrInvalidToken
+	}
+	user, err := cfg.db.GetUser(p.UserID)
+	if err != nil {
+		return nil, err
+	}
+	if user.Deleted() {
+		return nil, errors.New("User not found in database")
+	}
+	// personal access tokens are revoked one by one rather than by time
+	if p.TokenType != auth.TokenPersonal && user.TokenRevoked(p.IssuedAt, p.TokenVersion) {
+		return nil, errors.New("token has been revoked")
+	}
+	if !cfg.sessionActive(p) {
+		return nil, errors.New("session has been revoked")
+	}
+	// a token carries the role it was issued with; once the role changes
+	// the client has to refresh to pick up the new one
+	if !p.Delegated() && p.Role != user.Role {
+		return nil, errors.New("role has changed, refresh the token")
+	}
+	return user, nil
+}
 
-	mux.HandleFunc("POST /api/revoke", func(w http.ResponseWriter, r *http.Request) {
-		ts := r.Header.Get("Authorization")
-		if ts == "" {
-			jsonResponse(w, 401, "Authorization header is required")
-			return
-		}
-		ts = strings.Split(ts, " ")[1]
-		claims := jwt.MapClaims{}
-		_, err := jwt.ParseWithClaims(ts, claims, func(t *jwt.Token) (interface{}, error) {
-			return []byte(config.jwtSecret), nil
-		})
-		if err != nil {
-			log.Println(err.Error())
-			jsonResponse(w, 401, "invalid token")
-			return
+func main() {
+	c, args, err := config.Load(os.Args[1:], os.LookupEnv)
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	// the configuration is printed before it is validated, so that a
+	// broken one can be inspected
+	if len(args) == 2 && args[0] == "config" && args[1] == "print" {
+		err = c.Print(os.Stdout)
+		if err == nil {
+			err = c.Validate()
 		}
-		issuer, err := claims.GetIssuer()
 		if err != nil {
-			log.Println(err.Error())
-			jsonResponse(w, 401, "invalid token")
-			return
-		}
-		if issuer != "chirpy-refresh" {
-			log.Println("not a chirpy refresh token")
-			jsonResponse(w, 401, "invalid token")
-			return
+			log.Fatal(err)
 		}
-		err = db.RevokeToken(ts)
+		return
+	}
+	err = c.Validate()
+	if err != nil {
+		log.Fatalf("Invalid configuration:\n%v", err)
+	}
+	cfg, err := newConfig(c, time.Now)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if len(args) > 0 {
+		err := runCommand(cfg, args)
 		if err != nil {
-			log.Println("Failed to revoke refresh token")
-			jsonResponse(w, 500, "failed to revoke refresh token")
-			return
+			log.Fatal(err)
 		}
-		jsonResponse(w, 200, "success")
-	})
+		return
+	}
 
-	mux.HandleFunc("DELETE /api/chirps/{chirp_id}", config.HandleDeleteChirp)
+	go cfg.purgeDeletedUsers()
 
-	mux.HandleFunc("POST /api/polka/webhooks", config.HandlePolkaWebhook)
+	if cfg.keyRingPath != "" {
+		go cfg.reloadKeyRing()
+	}
 
-	fmt.Printf("Server listening at host http://localhost%v\n", port)
-	server.ListenAndServe()
+	server := http.Server{
+		Addr:    c.Addr(),
+		Handler: NewServer(cfg),
+	}
+	fmt.Printf("Server listening at %s\n", cfg.publicURL)
+	log.Fatal(server.ListenAndServe())
 }
@@ -0,0 +1,440 @@
+package main
+
+import (
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/chirps"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/metrics"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+)
+
+// Server is the Chirpy API: the routes of one apiConfig. Several can run
+// side by side, e.g. under httptest, sharing only the process-wide metrics
+// in internal/metrics, whose counters add up the requests of every Server.
+type Server struct {
+	cfg     *apiConfig
+	mux     *http.ServeMux
+	handler http.Handler
+}
+
+// NewServer registers the routes for cfg. Background work such as purging
+// deleted users is started separately, by the caller.
+func NewServer(cfg *apiConfig) *Server {
+	s := &Server{
+		cfg: cfg,
+		mux: http.NewServeMux(),
+	}
+	cfg.authenticator.SetPersonalTokenVerifier(cfg.verifyPersonalToken)
+	s.routes()
+	s.handler = metrics.Instrument(s.routePattern, middlewareCors(s.mux))
+	return s
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.handler.ServeHTTP(w, r)
+}
+
+// routePattern is the pattern of the route serving r, labelling request
+// metrics.
+func (s *Server) routePattern(r *http.Request) string {
+	_, pattern := s.mux.Handler(r)
+	return pattern
+}
+
+// handle registers a route together with the type of token it accepts; the
+// token is checked before the handler runs. auth.Public routes take none.
+func (s *Server) handle(pattern string, tokenType string, handler http.HandlerFunc) {
+	if tokenType == auth.Public {
+		s.mux.HandleFunc(pattern, handler)
+		return
+	}
+	s.mux.HandleFunc(pattern, s.cfg.authenticator.RequireFunc(tokenType, handler))
+}
+
+// handleScoped registers a route for access tokens and for personal access
+// tokens granted scope.
+func (s *Server) handleScoped(pattern string, scope string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.cfg.authenticator.RequireScopeFunc(scope, handler))
+}
+
+// handlePermitted registers a route for users whose role grants
+// permission. The user is loaded before the handler runs, so a revoked token
+// or a changed role is refused even if the handler never calls currentUser.
+func (s *Server) handlePermitted(pattern string, permission string, handler http.HandlerFunc) {
+	s.mux.HandleFunc(pattern, s.permitted(permission, handler))
+}
+
+// permitted wraps handler for handlePermitted.
+func (s *Server) permitted(permission string, handler http.HandlerFunc) http.HandlerFunc {
+	return s.cfg.authenticator.RequirePermissionFunc(permission, func(w http.ResponseWriter, r *http.Request) {
+		_, err := s.cfg.currentUser(r)
+		if err != nil {
+			errorResponse(w, 401, err)
+			return
+		}
+		handler(w, r)
+	})
+}
+
+// verified refuses users who have not verified their email address yet.
+// Routes that publish content or hand out access are wrapped in it; those
+// an unverified user needs to fix or secure the account are not.
+func (s *Server) verified(handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		user, err := s.cfg.currentUser(r)
+		if err != nil {
+			errorResponse(w, 401, err)
+			return
+		}
+		if !user.Verified() {
+			errorResponse(w, 403, errUnverified)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func (s *Server) routes() {
+	cfg, db := s.cfg, s.cfg.db
+
+	s.handle("/app/", auth.Public, cfg.middlewareMetricsInc(http.StripPrefix("/app", http.FileServer(http.Dir(".")))).ServeHTTP)
+
+	s.handle("GET /.well-known/jwks.json", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		jsonResponse(w, 200, cfg.authenticator.JWKS())
+	})
+
+	// Prometheus authenticates with METRICS_TOKEN rather than a user token
+	s.handle("GET /metrics", auth.Public, cfg.HandleMetrics)
+
+	s.handle("GET /api/healthz", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		w.WriteHeader(http.StatusOK)
+		w.Write([]byte("OK"))
+	})
+
+	s.handlePermitted("GET /admin/metrics", auth.PermViewMetrics, cfg.HandleAdminMetrics)
+
+	s.handlePermitted("GET /admin/stats", auth.PermViewMetrics, cfg.HandleAdminStats)
+
+	s.handlePermitted("GET /admin/audit", auth.PermViewAudit, cfg.HandleGetAuditLog)
+
+	s.handlePermitted("POST /api/reset", auth.PermReset, cfg.HandleReset)
+
+	s.handleScoped("POST /api/chirps", auth.ScopeChirpsWrite, s.verified(func(w http.ResponseWriter, r *http.Request) {
+		user, err := cfg.currentUser(r)
+		if err != nil {
+			errorResponse(w, 401, err)
+			return
+		}
+		req := payloads.ChirpPostBody{}
+		err = payloads.DecodeRequest(r, &req)
+		if err != nil {
+			errorResponse(w, 500, err)
+			return
+		}
+		s, err := chirps.Validate(req.Body)
+		if err != nil {
+			errorResponse(w, 400, err)
+			return
+		}
+		chirp, err := db.CreateChirp(s, user.ID)
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		jsonResponse(w, 201, chirp)
+	}))
+
+	s.handle("GET /api/chirps", auth.Public, cfg.authenticator.OptionalFunc(cfg.GetChirpsHandler))
+
+	s.handle("GET /api/chirps/{chirp_id}", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("chirp_id"))
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		chirp, err := db.GetChirp(id)
+		if err != nil {
+			jsonResponse(w, 404, err.Error())
+			return
+		}
+		jsonResponse(w, 200, chirp)
+	})
+
+	s.handle("POST /api/users", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		req := payloads.UsersPostBody{}
+		err := payloads.DecodeRequest(r, &req)
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		if !mail.ValidAddress(req.Email) {
+			jsonResponse(w, 400, "invalid email address")
+			return
+		}
+		err = cfg.passwords.Validate(req.Password)
+		if err != nil {
+			jsonResponse(w, 400, err.Error())
+			return
+		}
+		user, err := db.CreateUser(req.Email, req.Password, cfg.passwords)
+		if errors.Is(err, database.ErrEmailInUse) {
+			jsonResponse(w, 409, err.Error())
+			return
+		}
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		cfg.startVerification(user)
+		jsonResponse(w, 201, payloads.NewPrivateUser(user))
+	})
+
+	s.handle("PUT /api/users", auth.TokenAccess, func(w http.ResponseWriter, r *http.Request) {
+		req := payloads.UpdateRequest{}
+		err := payloads.DecodeRequest(r, &req)
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		user, err := cfg.currentUser(r)
+		if err != nil {
+			log.Println(err)
+			jsonResponse(w, 401, err.Error())
+			return
+		}
+		if req.Email == "" && req.Password == "" {
+			jsonResponse(w, 400, "nothing to update")
+			return
+		}
+		if req.Email != "" {
+			code, err := checkEmail(req.Email)
+			if err != nil {
+				jsonResponse(w, code, err.Error())
+				return
+			}
+		}
+		code, err := confirmPassword(user, req.CurrentPassword)
+		if err != nil {
+			jsonResponse(w, code, err.Error())
+			return
+		}
+		hash := ""
+		if req.Password != "" {
+			hash, code, err = cfg.changePassword(req.Password)
+			if err != nil {
+				jsonResponse(w, code, err.Error())
+				return
+			}
+		}
+		oldEmail, oldPassword := user.Email, user.Password
+		user, err = db.UpdateUser(user.ID, func(u *database.User) error {
+			if req.Email != "" {
+				setEmail(u, req.Email)
+			}
+			if hash != "" {
+				return cfg.setPassword(u, oldPassword, hash)
+			}
+			return nil
+		})
+		if err != nil {
+			updateUserFailed(w, err)
+			return
+		}
+		if user.Email != oldEmail {
+			cfg.startVerification(user)
+		}
+		if req.Password != "" {
+			err = db.RevokeUserRefreshTokens(user.ID)
+			if err != nil {
+				jsonResponse(w, 500, "Could not revoke refresh tokens")
+				return
+			}
+		}
+		jsonResponse(w, 200, payloads.NewPrivateUser(user))
+	})
+
+	s.handleScoped("GET /api/users/me", auth.ScopeProfileRead, cfg.HandleGetMe)
+
+	s.handleScoped("PATCH /api/users/me", auth.ScopeProfileWrite, cfg.HandlePatchMe)
+
+	s.handle("DELETE /api/users/me", auth.TokenAccess, cfg.HandleDeleteMe)
+
+	s.handle("POST /api/users/me/export", auth.TokenAccess, s.verified(cfg.HandleCreateExport))
+
+	s.handle("GET /api/users/me/export/{export_id}", auth.TokenAccess, cfg.HandleGetExport)
+
+	s.handle("GET /api/users/me/export/{export_id}/download", auth.TokenAccess, cfg.HandleDownloadExport)
+
+	s.handle("PUT /api/users/me/email", auth.TokenAccess, cfg.HandleChangeEmail)
+
+	s.handle("PUT /api/users/me/password", auth.TokenAccess, cfg.HandleChangePassword)
+
+	s.handle("POST /api/users/me/totp", auth.TokenAccess, cfg.HandleEnrolTOTP)
+
+	s.handle("POST /api/users/me/totp/confirm", auth.TokenAccess, cfg.HandleConfirmTOTP)
+
+	s.handle("DELETE /api/users/me/totp", auth.TokenAccess, cfg.HandleDisableTOTP)
+
+	s.handle("POST /api/users/me/verification", auth.TokenAccess, cfg.HandleResendVerification)
+
+	s.handle("GET /api/verify-email", auth.Public, cfg.HandleVerifyEmail)
+
+	s.handle("POST /api/password-reset", auth.Public, cfg.HandlePasswordReset)
+
+	s.handle("POST /api/password-reset/confirm", auth.Public, cfg.HandlePasswordResetConfirm)
+
+	s.handle("GET /api/users/{user_id}", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		id, err := strconv.Atoi(r.PathValue("user_id"))
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		user, err := db.GetUser(id)
+		if err != nil || user.Deleted() {
+			jsonResponse(w, 404, "User not found in database")
+			return
+		}
+		jsonResponse(w, 200, payloads.NewPublicUser(user))
+	})
+
+	s.handle("POST /api/login", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		req := payloads.LoginRequest{}
+		err := payloads.DecodeRequest(r, &req)
+		if err != nil {
+			jsonResponse(w, 500, err.Error())
+			return
+		}
+		user, ok := cfg.checkPassword(w, r, req.Email, req.Password)
+		if !ok {
+			return
+		}
+		if user.TwoFactorEnabled() {
+			metrics.Login(metrics.LoginMFARequired)
+			challenge, err := cfg.authenticator.IssueMFAChallenge(user.ID, user.TokenVersion)
+			if err != nil {
+				log.Printf("%v", err)
+				jsonResponse(w, 500, "Failed to generate login challenge")
+				return
+			}
+			jsonResponse(w, 200, payloads.MFAChallengeResponse{
+				MFARequired:    true,
+				ChallengeToken: challenge,
+				ExpiresIn:      int(cfg.authenticator.MFALifetime().Seconds()),
+			})
+			return
+		}
+		cfg.completeLogin(w, r, user, req.Device, req.ExpiresInSeconds)
+	})
+
+	s.handle("POST /api/login/totp", auth.Public, cfg.HandleLoginTOTP)
+
+	// refresh tokens are opaque rather than JWTs, so these routes check them
+	// against the database themselves
+	s.handle("POST /api/refresh", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		ts, err := auth.BearerToken(r.Header)
+		if err != nil {
+			jsonResponse(w, 401, err.Error())
+			return
+		}
+		refreshToken, rt, err := db.RotateRefreshToken(ts, "", requestClient(r), cfg.refreshTTL)
+		if errors.Is(err, database.ErrRefreshTokenReused) {
+			log.Println("refresh token reuse detected, family revoked")
+			jsonResponse(w, 401, "token is invalid")
+			return
+		}
+		if err != nil {
+			log.Println(err)
+			jsonResponse(w, 401, "token is invalid")
+			return
+		}
+		user, err := db.GetUser(rt.UserID)
+		if err != nil || user.Deleted() {
+			jsonResponse(w, 401, "token is invalid")
+			return
+		}
+		accessTTL := cfg.authenticator.AccessLifetime(0)
+		accessToken, err := user.GetAccessToken(cfg.authenticator, accessTTL)
+		if err != nil {
+			log.Println("Failed to refresh access token")
+			jsonResponse(w, 500, "failed to refresh access token")
+			return
+		}
+		jsonResponse(w, 200, payloads.RefreshResponse{
+			Token:        accessToken,
+			ExpiresIn:    int(accessTTL.Seconds()),
+			RefreshToken: refreshToken,
+		})
+	})
+
+	s.handle("POST /api/revoke", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		ts, err := auth.BearerToken(r.Header)
+		if err != nil {
+			jsonResponse(w, 401, err.Error())
+			return
+		}
+		err = db.RevokeRefreshToken(ts)
+		if errors.Is(err, database.ErrRefreshTokenInvalid) {
+			jsonResponse(w, 401, "token is invalid")
+			return
+		}
+		if err != nil {
+			log.Println("Failed to revoke refresh token")
+			jsonResponse(w, 500, "failed to revoke refresh token")
+			return
+		}
+		jsonResponse(w, 200, "success")
+	})
+
+	s.handle("GET /api/sessions", auth.TokenAccess, cfg.HandleGetSessions)
+
+	s.handle("DELETE /api/sessions", auth.TokenAccess, cfg.HandleRevokeAllSessions)
+
+	s.handle("DELETE /api/sessions/{session_id}", auth.TokenAccess, cfg.HandleRevokeSession)
+
+	s.handle("GET /api/tokens", auth.TokenAccess, cfg.HandleGetPersonalTokens)
+
+	s.handle("POST /api/tokens", auth.TokenAccess, s.verified(cfg.HandleCreatePersonalToken))
+
+	s.handle("DELETE /api/tokens/{token_id}", auth.TokenAccess, cfg.HandleRevokePersonalToken)
+
+	s.handle("GET /api/oauth/clients", auth.TokenAccess, cfg.HandleGetOAuthClients)
+
+	s.handle("POST /api/oauth/clients", auth.TokenAccess, s.verified(cfg.HandleCreateOAuthClient))
+
+	s.handle("DELETE /api/oauth/clients/{client_id}", auth.TokenAccess, cfg.HandleDeleteOAuthClient)
+
+	// the consent screen reads the authorization request, then posts the user's decision
+	s.handle("GET /api/oauth/authorize", auth.TokenAccess, cfg.HandleOAuthConsent)
+
+	s.handle("POST /api/oauth/authorize", auth.TokenAccess, s.verified(cfg.HandleOAuthAuthorize))
+
+	// OAuth clients authenticate with their own credentials rather than a token
+	s.handle("POST /api/oauth/token", auth.Public, cfg.HandleOAuthToken)
+
+	s.handle("POST /api/oauth/introspect", auth.Public, cfg.HandleOAuthIntrospect)
+
+	s.handleScoped("DELETE /api/chirps/{chirp_id}", auth.ScopeChirpsWrite, s.verified(cfg.HandleDeleteChirp))
+
+	s.handlePermitted("PUT /admin/users/{user_id}/role", auth.PermManageUsers, cfg.HandleSetRole)
+
+	// unlocking also accepts ADMIN_API_KEY in place of a token, so that a
+	// locked-out admin can still be let back in
+	unlock := s.permitted(auth.PermManageUsers, cfg.HandleUnlockUser)
+	s.handle("POST /admin/users/{user_id}/unlock", auth.Public, func(w http.ResponseWriter, r *http.Request) {
+		if cfg.isAdminRequest(r) {
+			cfg.HandleUnlockUser(w, r)
+			return
+		}
+		unlock(w, r)
+	})
+
+	// Polka authenticates with its own API key rather than a token
+	s.handle("POST /api/polka/webhooks", auth.Public, cfg.HandlePolkaWebhook)
+}
@@ -0,0 +1,989 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/am1macdonald/chirpy/internal/auth"
+	"github.com/am1macdonald/chirpy/internal/config"
+	"github.com/am1macdonald/chirpy/internal/database"
+	"github.com/am1macdonald/chirpy/internal/mail"
+	"github.com/am1macdonald/chirpy/internal/oauth"
+	"github.com/am1macdonald/chirpy/internal/payloads"
+	"github.com/am1macdonald/chirpy/internal/totp"
+	"golang.org/x/crypto/bcrypt"
+)
+
+const (
+	testPassword = "correct horse battery"
+	testPolkaKey = "polka-test-api-key"
+)
+
+func TestMain(m *testing.M) {
+	// handlers log freely; keep test output to the failures
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeClock is a clock that only moves when told to.
+type fakeClock struct {
+	mu sync.Mutex
+	t  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.t
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.t = c.t.Add(d)
+}
+
+// fakeMailer keeps sent messages instead of delivering them.
+type fakeMailer struct {
+	mu   sync.Mutex
+	sent []mail.Message
+}
+
+func (m *fakeMailer) Send(msg mail.Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.sent = append(m.sent, msg)
+	return nil
+}
+
+func (m *fakeMailer) count() int {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return len(m.sent)
+}
+
+// last returns the latest message sent to an address.
+func (m *fakeMailer) last(to string) (mail.Message, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i := len(m.sent) - 1; i >= 0; i-- {
+		if m.sent[i].To == to {
+			return m.sent[i], true
+		}
+	}
+	return mail.Message{}, false
+}
+
+// testServer is a Chirpy server over a temporary database, running on a
+// fake clock and a fake mailer.
+type testServer struct {
+	*httptest.Server
+	t      *testing.T
+	cfg    *apiConfig
+	clock  *fakeClock
+	mailer *fakeMailer
+}
+
+func newTestServer(t *testing.T) *testServer {
+	t.Helper()
+	clock := &fakeClock{t: time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)}
+	mailer := &fakeMailer{}
+	c := config.Default()
+	c.DatabasePath = filepath.Join(t.TempDir(), "database.json")
+	c.ExportDir = filepath.Join(t.TempDir(), "exports")
+	c.JWTSecret = "a test secret of thirty two bytes"
+	c.PolkaAPIKey = testPolkaKey
+	c.BcryptCost = bcrypt.MinCost
+	c.PublicURL = "http://localhost"
+	err := c.Validate()
+	if err != nil {
+		t.Fatalf("invalid test configuration: %v", err)
+	}
+	cfg, err := newConfig(c, clock.Now)
+	if err != nil {
+		t.Fatalf("failed to configure server: %v", err)
+	}
+	cfg.mailer = mailer
+	srv := httptest.NewUnstartedServer(NewServer(cfg))
+	cfg.publicURL = "http://" + srv.Listener.Addr().String()
+	srv.Start()
+	t.Cleanup(srv.Close)
+	return &testServer{Server: srv, t: t, cfg: cfg, clock: clock, mailer: mailer}
+}
+
+// request sends a request with an optional Authorization header value and
+// JSON body, returning the status code and response body.
+func (ts *testServer) request(method string, path string, authorization string, body any) (int, []byte) {
+	ts.t.Helper()
+	var r io.Reader
+	if body != nil {
+		b, err := json.Marshal(body)
+		if err != nil {
+			ts.t.Fatalf("failed to encode request: %v", err)
+		}
+		r = bytes.NewReader(b)
+	}
+	req, err := http.NewRequest(method, ts.URL+path, r)
+	if err != nil {
+		ts.t.Fatalf("failed to build request: %v", err)
+	}
+	if authorization != "" {
+		req.Header.Set("Authorization", authorization)
+	}
+	res, err := ts.Client().Do(req)
+	if err != nil {
+		ts.t.Fatalf("%s %s failed: %v", method, path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		ts.t.Fatalf("failed to read response: %v", err)
+	}
+	return res.StatusCode, data
+}
+
+// expect is request that fails the test on any other status code.
+func (ts *testServer) expect(code int, method string, path string, authorization string, body any) []byte {
+	ts.t.Helper()
+	got, data := ts.request(method, path, authorization, body)
+	if got != code {
+		ts.t.Fatalf("%s %s: expected status %d, got %d: %s", method, path, code, got, data)
+	}
+	return data
+}
+
+func decode[T any](t *testing.T, data []byte) T {
+	t.Helper()
+	var v T
+	err := json.Unmarshal(data, &v)
+	if err != nil {
+		t.Fatalf("failed to decode %q: %v", data, err)
+	}
+	return v
+}
+
+func bearer(token string) string {
+	return "Bearer " + token
+}
+
+func (ts *testServer) login(email string, plaintext string) payloads.LoginResponse {
+	ts.t.Helper()
+	data := ts.expect(200, "POST", "/api/login", "", payloads.LoginRequest{Email: email, Password: plaintext})
+	return decode[payloads.LoginResponse](ts.t, data)
+}
+
+// setRole gives the account a role, as `chirpy users create-admin` does,
+// and logs in again for a token carrying it.
+func (ts *testServer) setRole(email string, role string) payloads.LoginResponse {
+	ts.t.Helper()
+	user, err := ts.cfg.db.GetUserByEmail(email)
+	if err != nil {
+		ts.t.Fatalf("failed to load %s: %v", email, err)
+	}
+	_, err = ts.cfg.db.UpdateUser(user.ID, func(u *database.User) error {
+		u.Role = role
+		return nil
+	})
+	if err != nil {
+		ts.t.Fatalf("failed to give %s the %s role: %v", email, role, err)
+	}
+	return ts.login(email, testPassword)
+}
+
+// signup creates an account, follows the emailed verification link and
+// logs in.
+func (ts *testServer) signup(email string) payloads.LoginResponse {
+	ts.t.Helper()
+	ts.expect(201, "POST", "/api/users", "", payloads.UsersPostBody{Email: email, Password: testPassword})
+	msg, ok := ts.mailer.last(email)
+	if !ok {
+		ts.t.Fatalf("no verification email sent to %s", email)
+	}
+	link := ""
+	for _, line := range strings.Split(msg.Body, "\n") {
+		if strings.HasPrefix(line, ts.cfg.publicURL) {
+			link = strings.TrimPrefix(line, ts.cfg.publicURL)
+		}
+	}
+	ts.expect(200, "GET", link, "", nil)
+	return ts.login(email, testPassword)
+}
+
+func TestSignupAndLogin(t *testing.T) {
+	ts := newTestServer(t)
+	data := ts.expect(201, "POST", "/api/users", "", payloads.UsersPostBody{Email: "alice@example.com", Password: testPassword})
+	user := decode[payloads.PrivateUser](t, data)
+	if user.Email != "alice@example.com" || user.EmailVerified {
+		t.Fatalf("unexpected new user: %+v", user)
+	}
+	ts.expect(400, "POST", "/api/users", "", payloads.UsersPostBody{Email: "bob@example.com", Password: "password"})
+	ts.expect(400, "POST", "/api/users", "", payloads.UsersPostBody{Email: "not an address", Password: testPassword})
+	ts.expect(400, "POST", "/api/users", "", payloads.UsersPostBody{Email: "bob@example.com", Password: strings.Repeat("long ", 15)})
+
+	ts.expect(401, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: "wrong password"})
+	ts.expect(401, "POST", "/api/login", "", payloads.LoginRequest{Email: "nobody@example.com", Password: testPassword})
+	login := ts.login("alice@example.com", testPassword)
+	if login.ID != user.ID || login.Token == "" || login.RefreshToken == "" {
+		t.Fatalf("unexpected login response: %+v", login)
+	}
+	me := decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", bearer(login.Token), nil))
+	if me.ID != user.ID {
+		t.Fatalf("expected user %d, got %d", user.ID, me.ID)
+	}
+}
+
+func TestMe(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	token := bearer(alice.Token)
+	me := decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", token, nil))
+	want := payloads.PrivateUser{
+		Email:         "alice@example.com",
+		EmailVerified: true,
+		ID:            alice.ID,
+		Role:          auth.RoleUser,
+		Settings:      payloads.UserSettings{DefaultChirpSort: "asc"},
+	}
+	if me != want {
+		t.Fatalf("expected %+v, got %+v", want, me)
+	}
+
+	// settings left out of a patch keep their values
+	asc, desc, sideways := "asc", "desc", "sideways"
+	me = decode[payloads.PrivateUser](t, ts.expect(200, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{}))
+	if me.Settings != (payloads.UserSettings{DefaultChirpSort: "asc"}) {
+		t.Fatalf("unexpected settings after patch: %+v", me.Settings)
+	}
+	ts.expect(400, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{
+		Settings: &payloads.UserSettingsPatch{DefaultChirpSort: &sideways},
+	})
+	ts.expect(200, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{
+		Settings: &payloads.UserSettingsPatch{DefaultChirpSort: &desc},
+	})
+	me = decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", token, nil))
+	if me.Settings != (payloads.UserSettings{DefaultChirpSort: "desc"}) {
+		t.Fatalf("expected the settings to be saved, got %+v", me.Settings)
+	}
+
+	password := "another horse battery"
+	ts.expect(400, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{Password: &password})
+	ts.login("alice@example.com", testPassword)
+
+	// a delegated token may edit settings but not the email
+	client := decode[payloads.OAuthClientResponse](t, ts.expect(201, "POST", "/api/oauth/clients", token, payloads.OAuthClientRequest{
+		Name:         "app",
+		RedirectURIs: []string{testRedirectURI},
+		Scopes:       []string{"profile:read", "profile:write"},
+	}))
+	_, tokens := ts.exchange(client.ClientID, ts.authorize(alice.Token, client.ClientID), testCodeVerifier)
+	email := "alice@example.org"
+	ts.expect(403, "PATCH", "/api/users/me", bearer(tokens.AccessToken), payloads.UserPatchRequest{Email: &email})
+	ts.expect(200, "PATCH", "/api/users/me", bearer(tokens.AccessToken), payloads.UserPatchRequest{
+		Settings: &payloads.UserSettingsPatch{DefaultChirpSort: &asc},
+	})
+
+	// a stolen access token is not enough to change the email
+	ts.expect(401, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{Email: &email})
+	ts.expect(401, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{Email: &email, CurrentPassword: "wrong password"})
+	ts.expect(401, "PUT", "/api/users/me/email", token, payloads.EmailChangeRequest{Email: email})
+	ts.expect(401, "PUT", "/api/users", token, payloads.UpdateRequest{Email: email})
+
+	// a new email needs verifying again
+	me = decode[payloads.PrivateUser](t, ts.expect(200, "PATCH", "/api/users/me", token, payloads.UserPatchRequest{Email: &email, CurrentPassword: testPassword}))
+	if me.Email != email || me.EmailVerified {
+		t.Fatalf("expected an unverified %s, got %+v", email, me)
+	}
+	if _, ok := ts.mailer.last(email); !ok {
+		t.Fatalf("no verification email sent to %s", email)
+	}
+}
+
+// emails are one account whatever their case
+func TestEmailCase(t *testing.T) {
+	ts := newTestServer(t)
+	user := decode[payloads.PrivateUser](t, ts.expect(201, "POST", "/api/users", "", payloads.UsersPostBody{Email: "Alice@Example.com", Password: testPassword}))
+	if user.Email != "alice@example.com" {
+		t.Fatalf("expected the email to be stored in lower case, got %s", user.Email)
+	}
+	ts.expect(409, "POST", "/api/users", "", payloads.UsersPostBody{Email: "alice@example.com", Password: testPassword})
+	if login := ts.login("ALICE@example.com", testPassword); login.ID != user.ID {
+		t.Fatalf("expected to log in as user %d, got %d", user.ID, login.ID)
+	}
+	bob := ts.signup("bob@example.com")
+	ts.expect(409, "PUT", "/api/users/me/email", bearer(bob.Token), payloads.EmailChangeRequest{Email: "ALICE@example.com", CurrentPassword: testPassword})
+}
+
+func TestEmailVerification(t *testing.T) {
+	ts := newTestServer(t)
+	login := ts.signup("alice@example.com")
+	if !login.EmailVerified {
+		t.Fatal("expected the email to be verified")
+	}
+	ts.expect(400, "GET", "/api/verify-email?token=bogus", "", nil)
+	ts.expect(409, "POST", "/api/users/me/verification", bearer(login.Token), nil)
+}
+
+// until the email is verified, nothing can be published and no access
+// handed out
+func TestUnverifiedUser(t *testing.T) {
+	ts := newTestServer(t)
+	ts.expect(201, "POST", "/api/users", "", payloads.UsersPostBody{Email: "alice@example.com", Password: testPassword})
+	login := ts.login("alice@example.com", testPassword)
+	if login.EmailVerified {
+		t.Fatal("expected the email to be unverified")
+	}
+	token := bearer(login.Token)
+	ts.expect(403, "POST", "/api/chirps", token, payloads.ChirpPostBody{Body: "hello"})
+	ts.expect(403, "POST", "/api/tokens", token, payloads.PersonalTokenRequest{Name: "bot", Scopes: []string{"chirps:write"}})
+	ts.expect(403, "POST", "/api/oauth/clients", token, payloads.OAuthClientRequest{
+		Name:         "app",
+		RedirectURIs: []string{testRedirectURI},
+		Scopes:       []string{"profile:read"},
+	})
+	ts.expect(403, "POST", "/api/oauth/authorize", token, payloads.OAuthAuthorizeRequest{})
+	ts.expect(403, "POST", "/api/users/me/export", token, nil)
+	ts.expect(200, "GET", "/api/users/me", token, nil)
+}
+
+func TestAccessTokenExpiry(t *testing.T) {
+	ts := newTestServer(t)
+	login := ts.signup("alice@example.com")
+	ts.clock.Advance(time.Duration(login.ExpiresIn)*time.Second - time.Minute)
+	ts.expect(200, "GET", "/api/users/me", bearer(login.Token), nil)
+	ts.clock.Advance(time.Minute * 2)
+	ts.expect(401, "GET", "/api/users/me", bearer(login.Token), nil)
+}
+
+func TestRefreshAndRevoke(t *testing.T) {
+	ts := newTestServer(t)
+	login := ts.signup("alice@example.com")
+
+	refreshed := decode[payloads.RefreshResponse](t, ts.expect(200, "POST", "/api/refresh", bearer(login.RefreshToken), nil))
+	if refreshed.RefreshToken == login.RefreshToken {
+		t.Fatal("expected the refresh token to rotate")
+	}
+	ts.expect(200, "GET", "/api/users/me", bearer(refreshed.Token), nil)
+
+	// presenting the replaced token again revokes the whole family
+	ts.expect(401, "POST", "/api/refresh", bearer(login.RefreshToken), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(refreshed.RefreshToken), nil)
+
+	second := ts.login("alice@example.com", testPassword)
+	ts.expect(200, "POST", "/api/revoke", bearer(second.RefreshToken), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(second.RefreshToken), nil)
+	ts.expect(401, "POST", "/api/revoke", bearer("not a token"), nil)
+
+	third := ts.login("alice@example.com", testPassword)
+	ts.clock.Advance(ts.cfg.refreshTTL + time.Second)
+	ts.expect(401, "POST", "/api/refresh", bearer(third.RefreshToken), nil)
+}
+
+// resetToken asks for a password reset and returns the token emailed to
+// the address. The email is sent in the background.
+func (ts *testServer) resetToken(email string) string {
+	ts.t.Helper()
+	sent := ts.mailer.count()
+	ts.expect(202, "POST", "/api/password-reset", "", payloads.PasswordResetRequest{Email: email})
+	for i := 0; i < 100 && ts.mailer.count() == sent; i++ {
+		time.Sleep(time.Millisecond * 10)
+	}
+	msg, ok := ts.mailer.last(email)
+	if !ok || ts.mailer.count() == sent {
+		ts.t.Fatalf("no password reset email sent to %s", email)
+	}
+	lines := strings.Split(msg.Body, "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(line, "Your password reset token is:") && i+2 < len(lines) {
+			return lines[i+2]
+		}
+	}
+	ts.t.Fatalf("no token in %q", msg.Body)
+	return ""
+}
+
+func TestPasswordReset(t *testing.T) {
+	ts := newTestServer(t)
+	login := ts.signup("alice@example.com")
+	pat := decode[payloads.PersonalTokenResponse](t, ts.expect(201, "POST", "/api/tokens", bearer(login.Token), payloads.PersonalTokenRequest{
+		Name:   "bot",
+		Scopes: []string{"profile:read"},
+	}))
+	token := ts.resetToken("alice@example.com")
+	confirm := payloads.PasswordResetConfirmRequest{Token: token, NewPassword: "a brand new password"}
+	ts.expect(204, "POST", "/api/password-reset/confirm", "", confirm)
+	// the token is single use and every session and personal token is revoked
+	ts.expect(400, "POST", "/api/password-reset/confirm", "", confirm)
+	ts.expect(401, "GET", "/api/users/me", bearer(login.Token), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(login.RefreshToken), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(pat.Token), nil)
+	ts.expect(401, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword})
+	ts.login("alice@example.com", "a brand new password")
+}
+
+// a reset token sent before an email change must not work afterwards, nor
+// verify the new address
+func TestPasswordResetAfterEmailChange(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice@example.com")
+	token := ts.resetToken("alice@example.com")
+	login := ts.login("alice@example.com", testPassword)
+	ts.expect(200, "PUT", "/api/users/me/email", bearer(login.Token), payloads.EmailChangeRequest{Email: "mallory@example.com", CurrentPassword: testPassword})
+	ts.expect(400, "POST", "/api/password-reset/confirm", "", payloads.PasswordResetConfirmRequest{Token: token, NewPassword: "a brand new password"})
+	login = ts.login("mallory@example.com", testPassword)
+	me := decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", bearer(login.Token), nil))
+	if me.EmailVerified {
+		t.Fatal("expected the new address to stay unverified")
+	}
+}
+
+// export waits for the data export started by the request to finish
+// building in the background.
+func (ts *testServer) export(token string) payloads.ExportResponse {
+	ts.t.Helper()
+	export := decode[payloads.ExportResponse](ts.t, ts.expect(202, "POST", "/api/users/me/export", bearer(token), nil))
+	for i := 0; i < 100 && export.Status == string(database.ExportPending); i++ {
+		time.Sleep(time.Millisecond * 10)
+		export = decode[payloads.ExportResponse](ts.t, ts.expect(200, "GET", "/api/users/me/export/"+export.ID, bearer(token), nil))
+	}
+	return export
+}
+
+func TestExport(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	ts.expect(201, "POST", "/api/chirps", bearer(alice.Token), payloads.ChirpPostBody{Body: "my first chirp"})
+	export := ts.export(alice.Token)
+	if export.Status != string(database.ExportReady) || export.ExpiresAt == nil {
+		t.Fatalf("expected the export to be ready, got %+v", export)
+	}
+	download := "/api/users/me/export/" + export.ID + "/download"
+	data := ts.expect(200, "GET", download, bearer(alice.Token), nil)
+	zr, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		t.Fatalf("expected a zip archive: %v", err)
+	}
+	files := map[string][]byte{}
+	for _, f := range zr.File {
+		rc, err := f.Open()
+		if err != nil {
+			t.Fatalf("failed to open %s: %v", f.Name, err)
+		}
+		files[f.Name], err = io.ReadAll(rc)
+		rc.Close()
+		if err != nil {
+			t.Fatalf("failed to read %s: %v", f.Name, err)
+		}
+	}
+	profile := decode[payloads.PrivateUser](t, files["profile.json"])
+	if profile.Email != "alice@example.com" || !bytes.Contains(files["chirps.json"], []byte("my first chirp")) {
+		t.Fatalf("unexpected archive contents: %s %s", files["profile.json"], files["chirps.json"])
+	}
+
+	// other users cannot see the export, and it expires
+	bob := ts.signup("bob@example.com")
+	ts.expect(404, "GET", "/api/users/me/export/"+export.ID, bearer(bob.Token), nil)
+	ts.expect(404, "GET", download, bearer(bob.Token), nil)
+	ts.clock.Advance(exportTTL + time.Second)
+	alice = ts.login("alice@example.com", testPassword)
+	ts.expect(410, "GET", download, bearer(alice.Token), nil)
+}
+
+func TestSessions(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice@example.com")
+	laptop := decode[payloads.LoginResponse](t, ts.expect(200, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword, Device: "laptop"}))
+	phone := decode[payloads.LoginResponse](t, ts.expect(200, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword, Device: "phone"}))
+	sessions := func() map[string]payloads.SessionResponse {
+		data := ts.expect(200, "GET", "/api/sessions", bearer(laptop.Token), nil)
+		byDevice := map[string]payloads.SessionResponse{}
+		for _, s := range decode[[]payloads.SessionResponse](t, data) {
+			byDevice[s.Device] = s
+		}
+		return byDevice
+	}
+	listed := sessions()
+	if len(listed) != 3 || listed["laptop"].ID == "" || listed["phone"].ID == "" {
+		t.Fatalf("expected the signup, laptop and phone sessions, got %+v", listed)
+	}
+
+	// refreshing keeps the session and its device, moving its last use
+	ts.clock.Advance(time.Minute)
+	laptop.RefreshToken = decode[payloads.RefreshResponse](t, ts.expect(200, "POST", "/api/refresh", bearer(laptop.RefreshToken), nil)).RefreshToken
+	refreshed := sessions()
+	if len(refreshed) != 3 || refreshed["laptop"].ID != listed["laptop"].ID || !refreshed["laptop"].LastUsedAt.After(listed["laptop"].LastUsedAt) {
+		t.Fatalf("expected the laptop session to be refreshed in place, got %+v", refreshed)
+	}
+
+	// sessions can only be revoked by their owner
+	bob := ts.signup("bob@example.com")
+	ts.expect(404, "DELETE", "/api/sessions/"+listed["phone"].ID, bearer(bob.Token), nil)
+	ts.expect(204, "DELETE", "/api/sessions/"+listed["phone"].ID, bearer(laptop.Token), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(phone.RefreshToken), nil)
+	ts.expect(404, "DELETE", "/api/sessions/"+listed["phone"].ID, bearer(laptop.Token), nil)
+	if _, ok := sessions()["phone"]; ok {
+		t.Fatal("expected the phone session to be gone")
+	}
+
+	ts.expect(204, "DELETE", "/api/sessions", bearer(laptop.Token), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(laptop.RefreshToken), nil)
+	ts.expect(200, "GET", "/api/users/me", bearer(bob.Token), nil)
+}
+
+func TestChirps(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	bob := ts.signup("bob@example.com")
+
+	chirp := decode[database.Chirp](t, ts.expect(201, "POST", "/api/chirps", bearer(alice.Token), payloads.ChirpPostBody{Body: "I had something interesting for breakfast"}))
+	if chirp.AuthorID != alice.ID {
+		t.Fatalf("expected author %d, got %d", alice.ID, chirp.AuthorID)
+	}
+	ts.expect(201, "POST", "/api/chirps", bearer(bob.Token), payloads.ChirpPostBody{Body: "this is a kerfuffle"})
+	ts.expect(400, "POST", "/api/chirps", bearer(alice.Token), payloads.ChirpPostBody{Body: strings.Repeat("a", 141)})
+
+	path := "/api/chirps/" + strconv.Itoa(chirp.ID)
+	got := decode[database.Chirp](t, ts.expect(200, "GET", path, "", nil))
+	if got.Body != chirp.Body {
+		t.Fatalf("expected %q, got %q", chirp.Body, got.Body)
+	}
+	all := decode[[]database.Chirp](t, ts.expect(200, "GET", "/api/chirps", "", nil))
+	if len(all) != 2 {
+		t.Fatalf("expected 2 chirps, got %d", len(all))
+	}
+	bobs := decode[[]database.Chirp](t, ts.expect(200, "GET", "/api/chirps?author_id="+strconv.Itoa(bob.ID), "", nil))
+	if len(bobs) != 1 || bobs[0].Body != "this is a ****" {
+		t.Fatalf("expected bob's censored chirp, got %+v", bobs)
+	}
+
+	// oldest first, unless asked otherwise or the user prefers otherwise
+	order := func(token string, query string) []int {
+		ids := []int{}
+		for _, c := range decode[[]database.Chirp](t, ts.expect(200, "GET", "/api/chirps"+query, token, nil)) {
+			ids = append(ids, c.ID)
+		}
+		return ids
+	}
+	oldest, newest := []int{all[0].ID, all[1].ID}, []int{all[1].ID, all[0].ID}
+	if all[0].ID > all[1].ID || !slices.Equal(order("", "?sort=desc"), newest) {
+		t.Fatalf("expected chirps in ID order, got %v and %v", all, order("", "?sort=desc"))
+	}
+	desc := "desc"
+	ts.expect(200, "PATCH", "/api/users/me", bearer(bob.Token), payloads.UserPatchRequest{Settings: &payloads.UserSettingsPatch{DefaultChirpSort: &desc}})
+	if !slices.Equal(order(bearer(bob.Token), ""), newest) || !slices.Equal(order(bearer(bob.Token), "?sort=asc"), oldest) {
+		t.Fatal("expected bob's default order to apply unless the request asks for one")
+	}
+	if !slices.Equal(order(bearer(alice.Token), ""), oldest) || !slices.Equal(order("Bearer not-a-token", ""), oldest) {
+		t.Fatal("expected other requests to get the oldest chirps first")
+	}
+
+	ts.expect(403, "DELETE", path, bearer(bob.Token), nil)
+	ts.expect(200, "DELETE", path, bearer(alice.Token), nil)
+	ts.expect(404, "GET", path, "", nil)
+}
+
+// admins see statistics that leave out accounts pending deletion, and
+// their actions are audited
+func TestAdmin(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice@example.com")
+	admin := bearer(ts.setRole("alice@example.com", auth.RoleAdmin).Token)
+	bob := ts.signup("bob@example.com")
+	carol := ts.signup("carol@example.com")
+	ts.expect(201, "POST", "/api/chirps", bearer(bob.Token), payloads.ChirpPostBody{Body: "hello from bob"})
+	ts.expect(201, "POST", "/api/chirps", bearer(carol.Token), payloads.ChirpPostBody{Body: "hello from carol"})
+	ts.expect(200, "POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, map[string]any{"event": "user.upgraded", "data": map[string]int{"user_id": bob.ID}})
+	ts.expect(202, "DELETE", "/api/users/me", bearer(carol.Token), payloads.DeleteAccountRequest{Password: testPassword})
+	ts.expect(200, "GET", "/app/", "", nil)
+
+	stats := decode[payloads.StatsResponse](t, ts.expect(200, "GET", "/admin/stats?days=7", admin, nil))
+	if stats.Users != 2 || stats.Chirps != 1 || stats.ChirpyRed != 1 || stats.Hits != 1 {
+		t.Fatalf("unexpected stats: %+v", stats)
+	}
+	today := ts.clock.Now().Format(time.DateOnly)
+	if len(stats.Signups) != 7 || stats.Signups[6] != (payloads.DailyCountResponse{Day: today, Count: 2}) {
+		t.Fatalf("unexpected signups: %+v", stats.Signups)
+	}
+	ts.expect(400, "GET", "/admin/stats?days=0", admin, nil)
+	ts.expect(200, "GET", "/admin/metrics", admin, nil)
+
+	ts.expect(200, "POST", "/api/reset", admin, nil)
+	stats = decode[payloads.StatsResponse](t, ts.expect(200, "GET", "/admin/stats", admin, nil))
+	if stats.Hits != 0 {
+		t.Fatalf("expected the hits to be reset, got %d", stats.Hits)
+	}
+	ts.expect(200, "PUT", "/admin/users/"+strconv.Itoa(bob.ID)+"/role", admin, payloads.RoleRequest{Role: auth.RoleModerator})
+
+	entries := decode[[]database.AuditEntry](t, ts.expect(200, "GET", "/admin/audit", admin, nil))
+	if len(entries) != 2 {
+		t.Fatalf("expected two audit entries, got %+v", entries)
+	}
+	role, reset := entries[0], entries[1]
+	if role.Action != "role.set" || role.Target != "user:"+strconv.Itoa(bob.ID) || role.Detail != auth.RoleModerator || role.ActorID == 0 {
+		t.Fatalf("unexpected role change entry: %+v", role)
+	}
+	if reset.Action != "reset" || reset.Detail != "hits=1" || reset.ActorID != role.ActorID {
+		t.Fatalf("unexpected reset entry: %+v", reset)
+	}
+	// a moderator is not an admin
+	ts.expect(403, "GET", "/admin/audit", bearer(ts.login("bob@example.com", testPassword).Token), nil)
+}
+
+func TestPolkaUpgrade(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	event := map[string]any{"event": "user.upgraded", "data": map[string]int{"user_id": alice.ID}}
+
+	ts.expect(401, "POST", "/api/polka/webhooks", "", event)
+	ts.expect(401, "POST", "/api/polka/webhooks", "ApiKey wrong-key", event)
+	ts.expect(200, "POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, map[string]any{"event": "user.payment_failed"})
+	ts.expect(404, "POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, map[string]any{"event": "user.upgraded", "data": map[string]int{"user_id": 999}})
+
+	me := decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", bearer(alice.Token), nil))
+	if me.IsChirpyRed {
+		t.Fatal("expected no Chirpy Red before the upgrade")
+	}
+	ts.expect(200, "POST", "/api/polka/webhooks", "ApiKey "+testPolkaKey, event)
+	me = decode[payloads.PrivateUser](t, ts.expect(200, "GET", "/api/users/me", bearer(alice.Token), nil))
+	if !me.IsChirpyRed {
+		t.Fatal("expected Chirpy Red after the upgrade")
+	}
+}
+
+func TestAuthorizationFailures(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	ts.expect(201, "POST", "/api/users", "", payloads.UsersPostBody{Email: "bob@example.com", Password: testPassword})
+	unverified := ts.login("bob@example.com", testPassword)
+	chirp := payloads.ChirpPostBody{Body: "hello"}
+
+	tests := []struct {
+		name          string
+		method        string
+		path          string
+		authorization string
+		code          int
+	}{
+		{"no token", "POST", "/api/chirps", "", 401},
+		{"malformed header", "POST", "/api/chirps", "Bearer", 401},
+		{"wrong scheme", "POST", "/api/chirps", "Basic " + alice.Token, 401},
+		{"refresh token as access token", "POST", "/api/chirps", bearer(alice.RefreshToken), 401},
+		{"forged token", "POST", "/api/chirps", bearer(alice.Token + "x"), 401},
+		{"unverified email", "POST", "/api/chirps", bearer(unverified.Token), 403},
+		{"admin route as user", "GET", "/admin/stats", bearer(alice.Token), 403},
+		{"reset as user", "POST", "/api/reset", bearer(alice.Token), 403},
+		{"reset with GET", "GET", "/api/reset", bearer(alice.Token), 405},
+		{"role change as user", "PUT", "/admin/users/1/role", bearer(alice.Token), 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			code, data := ts.request(tt.method, tt.path, tt.authorization, chirp)
+			if code != tt.code {
+				t.Fatalf("expected status %d, got %d: %s", tt.code, code, data)
+			}
+		})
+	}
+
+	// signing out everywhere revokes every token issued so far
+	ts.expect(204, "DELETE", "/api/sessions", bearer(alice.Token), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(alice.Token), nil)
+	ts.expect(401, "POST", "/api/refresh", bearer(alice.RefreshToken), nil)
+}
+
+// the clock does not move here, so every token is issued in the same
+// second as the revocations
+func TestRevokeInSameSecond(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice@example.com")
+	first := ts.login("alice@example.com", testPassword)
+	second := ts.login("alice@example.com", testPassword)
+	ts.expect(200, "PUT", "/api/users/me/password", bearer(first.Token), payloads.PasswordChangeRequest{
+		CurrentPassword: testPassword,
+		NewPassword:     "a brand new password",
+	})
+	ts.expect(401, "GET", "/api/users/me", bearer(first.Token), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(second.Token), nil)
+
+	// tokens issued after the revocation still work
+	third := ts.login("alice@example.com", "a brand new password")
+	ts.expect(200, "GET", "/api/users/me", bearer(third.Token), nil)
+	ts.expect(204, "DELETE", "/api/sessions", bearer(third.Token), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(third.Token), nil)
+	fourth := ts.login("alice@example.com", "a brand new password")
+	ts.expect(200, "GET", "/api/users/me", bearer(fourth.Token), nil)
+}
+
+// postForm sends a form-encoded POST, as OAuth clients do, returning the
+// status code and response body.
+func (ts *testServer) postForm(path string, form url.Values) (int, []byte) {
+	ts.t.Helper()
+	res, err := ts.Client().PostForm(ts.URL+path, form)
+	if err != nil {
+		ts.t.Fatalf("POST %s failed: %v", path, err)
+	}
+	defer res.Body.Close()
+	data, err := io.ReadAll(res.Body)
+	if err != nil {
+		ts.t.Fatalf("failed to read response: %v", err)
+	}
+	return res.StatusCode, data
+}
+
+const (
+	testRedirectURI  = "https://app.example.com/callback"
+	testCodeVerifier = "a-code-verifier-of-at-least-forty-three-characters"
+)
+
+// authorize approves an authorization request for clientID and returns the
+// code sent back to the client.
+func (ts *testServer) authorize(token string, clientID string) string {
+	ts.t.Helper()
+	data := ts.expect(200, "POST", "/api/oauth/authorize", bearer(token), payloads.OAuthAuthorizeRequest{
+		ResponseType:        "code",
+		ClientID:            clientID,
+		RedirectURI:         testRedirectURI,
+		CodeChallenge:       oauth.Challenge(testCodeVerifier),
+		CodeChallengeMethod: oauth.MethodS256,
+		Approve:             true,
+	})
+	to, err := url.Parse(decode[payloads.OAuthAuthorizeResponse](ts.t, data).RedirectTo)
+	if err != nil || to.Query().Get("code") == "" {
+		ts.t.Fatalf("expected a code in the redirect, got %s", data)
+	}
+	return to.Query().Get("code")
+}
+
+// exchange redeems an authorization code at the token endpoint.
+func (ts *testServer) exchange(clientID string, code string, verifier string) (int, payloads.OAuthTokenResponse) {
+	ts.t.Helper()
+	status, data := ts.postForm("/api/oauth/token", url.Values{
+		"grant_type":    {"authorization_code"},
+		"client_id":     {clientID},
+		"code":          {code},
+		"redirect_uri":  {testRedirectURI},
+		"code_verifier": {verifier},
+	})
+	if status != 200 {
+		return status, payloads.OAuthTokenResponse{}
+	}
+	return status, decode[payloads.OAuthTokenResponse](ts.t, data)
+}
+
+func TestOAuthAuthorizationCode(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	client := decode[payloads.OAuthClientResponse](t, ts.expect(201, "POST", "/api/oauth/clients", bearer(alice.Token), payloads.OAuthClientRequest{
+		Name:         "app",
+		RedirectURIs: []string{testRedirectURI},
+		Scopes:       []string{"profile:read"},
+	}))
+
+	// a failed exchange uses the code up
+	code := ts.authorize(alice.Token, client.ClientID)
+	if status, _ := ts.exchange(client.ClientID, code, "a-wrong-verifier-of-at-least-forty-three-characters"); status != 400 {
+		t.Fatalf("expected a wrong verifier to be rejected, got %d", status)
+	}
+	if status, _ := ts.exchange(client.ClientID, code, testCodeVerifier); status != 400 {
+		t.Fatalf("expected the code to be used up, got %d", status)
+	}
+
+	code = ts.authorize(alice.Token, client.ClientID)
+	status, tokens := ts.exchange(client.ClientID, code, testCodeVerifier)
+	if status != 200 {
+		t.Fatalf("expected the code to be exchanged, got %d", status)
+	}
+	ts.expect(200, "GET", "/api/users/me", bearer(tokens.AccessToken), nil)
+
+	// presenting the code again revokes what it was exchanged for
+	if status, _ := ts.exchange(client.ClientID, code, testCodeVerifier); status != 400 {
+		t.Fatalf("expected a reused code to be rejected, got %d", status)
+	}
+	ts.expect(401, "GET", "/api/users/me", bearer(tokens.AccessToken), nil)
+	status, _ = ts.postForm("/api/oauth/token", url.Values{
+		"grant_type":    {"refresh_token"},
+		"client_id":     {client.ClientID},
+		"refresh_token": {tokens.RefreshToken},
+	})
+	if status != 400 {
+		t.Fatalf("expected the refresh token to be revoked, got %d", status)
+	}
+
+	// signing out everywhere also voids codes not yet exchanged
+	code = ts.authorize(alice.Token, client.ClientID)
+	ts.expect(204, "DELETE", "/api/sessions", bearer(alice.Token), nil)
+	if status, _ := ts.exchange(client.ClientID, code, testCodeVerifier); status != 400 {
+		t.Fatalf("expected a code issued before the revocation to be rejected, got %d", status)
+	}
+
+	// nor does a signed-out token get to the consent screen
+	consent := "/api/oauth/authorize?" + url.Values{
+		"response_type":         {"code"},
+		"client_id":             {client.ClientID},
+		"redirect_uri":          {testRedirectURI},
+		"code_challenge":        {oauth.Challenge(testCodeVerifier)},
+		"code_challenge_method": {oauth.MethodS256},
+	}.Encode()
+	ts.expect(401, "GET", consent, bearer(alice.Token), nil)
+	alice = ts.login("alice@example.com", testPassword)
+	ts.expect(200, "GET", consent, bearer(alice.Token), nil)
+}
+
+func TestDeleteAccount(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	pat := decode[payloads.PersonalTokenResponse](t, ts.expect(201, "POST", "/api/tokens", bearer(alice.Token), payloads.PersonalTokenRequest{
+		Name:   "bot",
+		Scopes: []string{"profile:read"},
+	}))
+	ts.expect(200, "GET", "/api/users/me", bearer(pat.Token), nil)
+
+	ts.expect(401, "DELETE", "/api/users/me", bearer(alice.Token), payloads.DeleteAccountRequest{Password: "wrong password"})
+	ts.expect(202, "DELETE", "/api/users/me", bearer(alice.Token), payloads.DeleteAccountRequest{Password: testPassword})
+	ts.expect(401, "GET", "/api/users/me", bearer(alice.Token), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(pat.Token), nil)
+
+	// logging in within the grace period restores the account, but not
+	// its personal access tokens
+	restored := ts.login("alice@example.com", testPassword)
+	ts.expect(200, "GET", "/api/users/me", bearer(restored.Token), nil)
+	ts.expect(401, "GET", "/api/users/me", bearer(pat.Token), nil)
+
+	ts.expect(202, "DELETE", "/api/users/me", bearer(restored.Token), payloads.DeleteAccountRequest{Password: testPassword})
+	ts.clock.Advance(ts.cfg.deletionGrace + time.Second)
+	ts.expect(401, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword})
+}
+
+// a login challenge is exchanged for tokens once
+func TestLoginChallengeSingleUse(t *testing.T) {
+	ts := newTestServer(t)
+	alice := ts.signup("alice@example.com")
+	enrol := decode[payloads.TOTPEnrolResponse](t, ts.expect(200, "POST", "/api/users/me/totp", bearer(alice.Token), payloads.TOTPEnrolRequest{Password: testPassword}))
+	code := func() string {
+		c, err := totp.Code(enrol.Secret, totp.Counter(ts.clock.Now()))
+		if err != nil {
+			t.Fatalf("failed to generate code: %v", err)
+		}
+		return c
+	}
+	recovery := decode[payloads.RecoveryCodesResponse](t, ts.expect(200, "POST", "/api/users/me/totp/confirm", bearer(alice.Token), payloads.TOTPCodeRequest{Code: code()}))
+	challenge := func() string {
+		data := ts.expect(200, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword})
+		return decode[payloads.MFAChallengeResponse](t, data).ChallengeToken
+	}
+
+	first := challenge()
+	ts.clock.Advance(time.Second * 30)
+	ts.expect(200, "POST", "/api/login/totp", "", payloads.LoginTOTPRequest{ChallengeToken: first, Code: code()})
+	// a second code does not reuse the challenge, nor is it used up
+	ts.expect(401, "POST", "/api/login/totp", "", payloads.LoginTOTPRequest{ChallengeToken: first, Code: recovery.RecoveryCodes[0]})
+	ts.expect(200, "POST", "/api/login/totp", "", payloads.LoginTOTPRequest{ChallengeToken: challenge(), Code: recovery.RecoveryCodes[0]})
+
+	// nor can a code be spent twice through separate challenges, even at once
+	ts.clock.Advance(time.Second * 30)
+	for _, c := range []string{code(), recovery.RecoveryCodes[1]} {
+		challenges := []string{challenge(), challenge(), challenge()}
+		var wg sync.WaitGroup
+		var accepted atomic.Int32
+		for _, ch := range challenges {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				if status, _ := ts.request("POST", "/api/login/totp", "", payloads.LoginTOTPRequest{ChallengeToken: ch, Code: c}); status == 200 {
+					accepted.Add(1)
+				}
+			}()
+		}
+		wg.Wait()
+		if accepted.Load() != 1 {
+			t.Fatalf("expected code %s to log in once, got %d", c, accepted.Load())
+		}
+	}
+}
+
+// lockouts are lifted by users who may manage users, or with the admin key
+func TestUnlockUser(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.adminKey = "admin-test-api-key"
+	alice := ts.signup("alice@example.com")
+	ts.signup("bob@example.com")
+	bob, err := ts.cfg.db.GetUserByEmail("bob@example.com")
+	if err != nil {
+		t.Fatalf("failed to load bob: %v", err)
+	}
+	unlock := "/admin/users/" + strconv.Itoa(bob.ID) + "/unlock"
+	lockOut := func() {
+		for i := 0; i < accountLoginPolicy.LockoutAfter; i++ {
+			ts.cfg.loginAccounts.Fail(accountKey(bob.Email))
+		}
+		ts.expect(429, "POST", "/api/login", "", payloads.LoginRequest{Email: bob.Email, Password: testPassword})
+	}
+
+	lockOut()
+	ts.expect(401, "POST", unlock, "", nil)
+	ts.expect(403, "POST", unlock, bearer(alice.Token), nil)
+	admin := ts.setRole("alice@example.com", auth.RoleAdmin)
+	ts.expect(204, "POST", unlock, bearer(admin.Token), nil)
+	ts.login(bob.Email, testPassword)
+
+	lockOut()
+	ts.expect(401, "POST", unlock, "ApiKey wrong-key", nil)
+	ts.expect(204, "POST", unlock, "ApiKey "+ts.cfg.adminKey, nil)
+	ts.login(bob.Email, testPassword)
+}
+
+func TestLoginThrottle(t *testing.T) {
+	ts := newTestServer(t)
+	ts.signup("alice@example.com")
+	wrong := payloads.LoginRequest{Email: "alice@example.com", Password: "wrong password"}
+	throttled := false
+	for i := 0; i < accountLoginPolicy.FreeAttempts+2 && !throttled; i++ {
+		code, _ := ts.request("POST", "/api/login", "", wrong)
+		throttled = code == 429
+	}
+	if !throttled {
+		t.Fatal("expected repeated failures to be throttled")
+	}
+	// the right password has to wait too
+	ts.expect(429, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword})
+	ts.clock.Advance(accountLoginPolicy.MaxDelay)
+	ts.login("alice@example.com", testPassword)
+}
+
+// scrapes need the metrics token, and requests are counted by route pattern
+func TestMetrics(t *testing.T) {
+	ts := newTestServer(t)
+	ts.cfg.metricsToken = "metrics-test-token"
+	ts.expect(404, "GET", "/api/chirps/999999", "", nil)
+	ts.expect(401, "GET", "/metrics", "", nil)
+	ts.expect(401, "GET", "/metrics", bearer("not-the-metrics-token"), nil)
+	data := ts.expect(200, "GET", "/metrics", bearer(ts.cfg.metricsToken), nil)
+	want := `chirpy_http_requests_total{code="404",method="GET",route="GET /api/chirps/{chirp_id}"}`
+	if !bytes.Contains(data, []byte(want)) {
+		t.Fatalf("expected %s in the scrape, got:\n%s", want, data)
+	}
+	if bytes.Contains(data, []byte("/api/chirps/999999")) {
+		t.Fatal("expected paths not to be used as labels")
+	}
+}
+
+// Servers share no data, so tests can run several side by side; only the
+// metrics are process-wide.
+func TestServersAreIndependent(t *testing.T) {
+	a, b := newTestServer(t), newTestServer(t)
+	a.signup("alice@example.com")
+	b.expect(401, "POST", "/api/login", "", payloads.LoginRequest{Email: "alice@example.com", Password: testPassword})
+}